@@ -20,6 +20,15 @@ func parseNsshOptions(gdshOpts *GdshOptions) (ssh_args []string) {
 	// user@hostname is a definite match for hostname, split & replace with -o options
 	user_at_re := regexp.MustCompile("^[-a-z0-9]+@[-.a-zA-Z0-9]+$")
 
+	// --jump/-J and --proxy-command are gdsh options too, so they've already
+	// been taken out of the arguments
+	if gdshOpts.Jump != "" {
+		ssh_args = append(ssh_args, "-J", gdshOpts.Jump)
+	}
+	if gdshOpts.ProxyCmd != "" {
+		ssh_args = append(ssh_args, "-o", fmt.Sprintf("ProxyCommand %s", gdshOpts.ProxyCmd))
+	}
+
 	skip := false
 	for i, arg := range gdshOpts.Args {
 		if skip {
@@ -28,17 +28,16 @@ func (task *pullTask) Run(conn *gdssh.Conn) error {
 	hostpath := path.Join(task.local, conn.Host)
 	os.Mkdir(hostpath, 0755)
 	local := path.Join(hostpath, bname)
-	conn.ScpPull(local, task.remote)
-	return nil
+	return conn.ScpPull(local, task.remote)
 }
 
 func cmdPull(opt GdshOptions) int {
 	pool := sshPool(opt)
 	task := parsePullOptions(opt)
-	pool.All(task)
-	pool.Close()
+	results := pool.All(task)
+	closePool(pool)
 
-	return 1
+	return reportErrors(pool, results)
 }
 
 // vim: ts=4 sw=4 noet tw=120 softtabstop=4
@@ -63,17 +63,16 @@ func parsePushOptions(opt GdshOptions) *pushTask {
 // the file will be opened for each remote host, but that's fine since
 // the reads will end up shared on modern operating systems
 func (task *pushTask) Run(conn *gdssh.Conn) error {
-	conn.ScpPush(task.local, task.remote)
-	return nil
+	return conn.ScpPush(task.local, task.remote)
 }
 
 func cmdPush(opt GdshOptions) int {
 	pool := sshPool(opt)
 	task := parsePushOptions(opt)
-	pool.All(task)
-	pool.Close()
+	results := pool.All(task)
+	closePool(pool)
 
-	return 1
+	return reportErrors(pool, results)
 }
 
 // vim: ts=4 sw=4 noet tw=120 softtabstop=4
@@ -3,10 +3,18 @@ package main
 import (
 	"./src/gdssh"
 	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
 	"fmt"
+	"golang.org/x/term"
 	"io"
 	"log"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"text/template"
 	"time"
 )
@@ -43,41 +51,404 @@ EXIT=$?
 exit $EXIT
 `
 
+// exit statuses for gdsh run, worst wins
+const (
+	exitOk          = 0   // every host ran the command and it exited 0
+	exitFailed      = 1   // at least one remote command exited non-zero or was killed by a signal
+	exitUnreachable = 2   // at least one host never returned an exit status
+	exitInterrupted = 130 // interrupted by SIGINT/SIGTERM, like a shell would report
+)
+
+// --stderr modes
+const (
+	stderrPrefix = "prefix" // print with the host prefix on stdout, but with ! instead of :
+	stderrMerge  = "merge"  // interleave with stdout as it arrives, no distinction
+	stderrHide   = "hide"   // read and discard
+	stderrLocal  = "local"  // print to local stderr with the usual host prefix
+)
+
 // implements gdssh.Task for use with gdssh.Pool.All()
 type runTask struct {
 	filename string
 	script   *bytes.Buffer
 	env      map[string]string
-	format   string
-	rcodes   map[string]int
-	errors   map[string]error
+	format   string          // stdout line prefix format, pads the host
+	errfmt   string          // stderr line prefix format for stderrPrefix
+	stderr   string          // one of the stderr* modes
+	stream   bool            // print lines as they arrive instead of after the command exits
+	collate  bool            // save output in the results and print identical outputs once at the end
+	pty      *gdssh.Pty      // --tty
+	sudo     *gdssh.Password // --sudo-password
+	input    *stdinSpool     // local stdin for every host, nil when it's not sent
+	lock     sync.Mutex      // keeps each host's output together
+}
+
+// attached to the result of every host where the command ran
+type runStatus struct {
+	rc     int    // remote exit status, gdssh.ExitConnLost if there wasn't one
+	signal string // signal that killed the remote command, if any
 }
 
 func (task *runTask) Run(conn *gdssh.Conn) error {
-	conn.ScpBuf(task.script.Bytes(), "0555", task.filename)
-	cmd := conn.Command(task.filename, task.env)
-	rc, err := cmd.Run()
+	return task.RunResult(context.Background(), conn, &gdssh.Result{Host: conn.Host})
+}
+
+func (task *runTask) RunResult(ctx context.Context, conn *gdssh.Conn, res *gdssh.Result) error {
+	if err := conn.ScpBuf(task.script.Bytes(), "0555", task.filename); err != nil {
+		return err
+	}
+	cmd := conn.CommandContext(ctx, task.filename, task.env)
+	cmd.Pty = task.pty
+	cmd.SudoPassword = task.sudo
+
+	out := io.Writer(os.Stdout)
+	prefix := fmt.Sprintf(task.format, conn.Host)
+	errprefix := fmt.Sprintf(task.errfmt, conn.Host)
+	var collected bytes.Buffer
+	if task.collate {
+		// output can only be compared across hosts without the host prefix
+		out, prefix, errprefix = &collected, "", "! "
+	}
+
+	stdout := newLineWriter(out, prefix, task.stream, &task.lock)
+	var stderr *lineWriter
+	switch task.stderr {
+	case stderrPrefix:
+		stderr = newLineWriter(out, errprefix, task.stream, &task.lock)
+	case stderrLocal:
+		stderr = newLineWriter(os.Stderr, fmt.Sprintf(task.format, conn.Host), task.stream, &task.lock)
+	case stderrMerge:
+		stderr = stdout
+	}
+
+	// both streams have to be read while the command runs, otherwise the
+	// forwarding goroutines block and the remote command stalls
+	copied := make(chan bool)
+	go func() {
+		copyOutput(cmd, stdout, stderr)
+		copied <- true
+	}()
+
+	// remote stdin gets local stdin or nothing, except on a tty where sudo
+	// may still need it. --stdin and --tty don't go together.
+	var stopInput func()
+	if task.input != nil {
+		stopInput = task.input.feed(cmd)
+	} else if task.pty == nil {
+		close(cmd.Stdin)
+	}
+
+	rc, signal, err := cmd.Run()
+	if stopInput != nil {
+		stopInput()
+	}
+	<-copied
+	task.cleanup(conn)
+
+	// Run is called concurrently for every host by pool.All, hold the lock
+	// while printing so each host's buffered output comes out in one block
+	task.lock.Lock()
+	stdout.flush()
+	if stderr != nil && stderr != stdout {
+		stderr.flush()
+	}
+	task.lock.Unlock()
+
+	// output is unprefixed when collating so it can be compared across hosts
+	if task.collate {
+		res.Output = collected.Bytes()
+	}
+	res.Value = runStatus{rc: rc, signal: signal}
+
+	// the summary goes by runStatus, but Rolling counts all of these as failures
+	if err != nil {
+		return err
+	} else if signal != "" {
+		return fmt.Errorf("killed by SIG%s", signal)
+	} else if rc != 0 {
+		return fmt.Errorf("exit status %d", rc)
+	}
+	return nil
+}
+
+// --tty gets the size of the local terminal, less the width of the host
+// prefix so lines still fit, or 80x24 if there isn't one
+func ptySize(prefix int) (rows int, cols int) {
+	rows, cols = 24, 80
+	for _, f := range []*os.File{os.Stdout, os.Stderr, os.Stdin} {
+		if w, h, err := term.GetSize(int(f.Fd())); err == nil {
+			rows, cols = h, w
+			break
+		}
+	}
+	if cols-prefix >= 40 {
+		cols -= prefix
+	}
+	return
+}
+
+// for --sudo-password, from $GDSH_SUDO_PASSWORD or asked for once
+func sudoPassword() *gdssh.Password {
+	if pw, err := gdssh.EnvPassword("GDSH_SUDO_PASSWORD"); err == nil {
+		return pw
+	}
+	return gdssh.PromptFor("sudo password (used for all hosts): ")
+}
 
-	stdout := cmd.DrainStdout()
-	trimmed := bytes.Trim(stdout.Bytes(), "\r\n")
-	for _, str := range bytes.Split(trimmed, []byte{'\r', '\n'}) {
-		fmt.Printf(task.format, conn.Host, str)
+// a stopped rollout leaves hosts out of the results, the ones that never
+// connected are reported as unreachable rather than as not attempted
+func addUnreachable(results map[string]gdssh.Result, never []*gdssh.Conn) {
+	for _, conn := range never {
+		if _, ok := results[conn.Host]; ok {
+			continue
+		}
+		if err := conn.LastError(); err != nil {
+			results[conn.Host] = gdssh.Result{Host: conn.Host, Err: &gdssh.UnreachableError{Host: conn.Host, Err: err}}
+		}
 	}
+}
 
-	// not used yet, but silences compiler, need to figure out
-	// a useful way to use these
-	task.rcodes[conn.Host] = rc
-	task.errors[conn.Host] = err
+// remove the pushed script, which is left behind when the command is
+// interrupted or timed out and for scripts pushed with --script. No deadline,
+// it should happen even after --total-timeout.
+func (task *runTask) cleanup(conn *gdssh.Conn) {
+	rm := conn.Command(fmt.Sprintf("rm -f %s", task.filename), nil)
+	rm.Timeout = gdssh.KillGrace
+	go rm.DrainStdout()
+	go rm.DrainStderr()
+	rm.Run()
+}
 
+// implements gdssh.Task for the --health-check command of rolling runs,
+// output is thrown away and only the exit status matters
+type checkTask struct {
+	command string
+	env     map[string]string
+}
+
+func (task *checkTask) Run(conn *gdssh.Conn) error {
+	return task.RunResult(context.Background(), conn, &gdssh.Result{Host: conn.Host})
+}
+
+// a ResultTask only to get the deadline of the batch
+func (task *checkTask) RunResult(ctx context.Context, conn *gdssh.Conn, res *gdssh.Result) error {
+	cmd := conn.CommandContext(ctx, task.command, task.env)
+	go cmd.DrainStdout()
+	go cmd.DrainStderr()
+
+	rc, signal, err := cmd.Run()
+	if err != nil {
+		return err
+	} else if signal != "" {
+		return fmt.Errorf("killed by SIG%s", signal)
+	} else if rc != 0 {
+		return fmt.Errorf("exited %d", rc)
+	}
 	return nil
 }
 
+// --batch is either a number of hosts or a percentage of the list, the
+// result is always at least 1
+func batchSize(batch string, total int) int {
+	size := 0
+	if strings.HasSuffix(batch, "%") {
+		pct, err := strconv.Atoi(strings.TrimSuffix(batch, "%"))
+		if err != nil || pct <= 0 || pct > 100 {
+			log.Fatal("--batch percentage must be between 1% and 100%, got '", batch, "'")
+		}
+		size = total * pct / 100
+	} else {
+		n, err := strconv.Atoi(batch)
+		if err != nil || n <= 0 {
+			log.Fatal("--batch requires a host count or percentage, got '", batch, "'")
+		}
+		size = n
+	}
+
+	if size < 1 {
+		size = 1
+	}
+	return size
+}
+
+// hosts that produced byte-for-byte identical output
+type outputGroup struct {
+	hosts  []string
+	output []byte
+}
+
+// most common output first, so the outliers end up at the bottom near the summary
+type byPopularity []*outputGroup
+
+func (s byPopularity) Len() int      { return len(s) }
+func (s byPopularity) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byPopularity) Less(i, j int) bool {
+	if len(s[i].hosts) != len(s[j].hosts) {
+		return len(s[i].hosts) > len(s[j].hosts)
+	}
+	return s[i].hosts[0] < s[j].hosts[0]
+}
+
+// print each distinct output once under a header listing the hosts it came from, dshbak -c style
+func printCollated(w io.Writer, results map[string]gdssh.Result) {
+	groups := make(map[[sha1.Size]byte]*outputGroup)
+	for host, res := range results {
+		if _, ran := res.Value.(runStatus); !ran {
+			continue
+		}
+		output := res.Output
+		sum := sha1.Sum(output)
+		if group, ok := groups[sum]; ok {
+			group.hosts = append(group.hosts, host)
+		} else {
+			groups[sum] = &outputGroup{hosts: []string{host}, output: output}
+		}
+	}
+
+	sorted := make(byPopularity, 0, len(groups))
+	for _, group := range groups {
+		sort.Strings(group.hosts)
+		sorted = append(sorted, group)
+	}
+	sort.Sort(sorted)
+
+	for _, group := range sorted {
+		plural := "s"
+		if len(group.hosts) == 1 {
+			plural = ""
+		}
+		fmt.Fprintf(w, "----------------\n%s (%d host%s)\n----------------\n",
+			compactHosts(group.hosts), len(group.hosts), plural)
+		if len(group.output) == 0 {
+			fmt.Fprintf(w, "(no output)\n")
+		} else {
+			w.Write(group.output)
+		}
+	}
+}
+
+// one line of the summary table, hosts grouped by outcome
+type summaryLine struct {
+	rank   int // sort order & exit status contribution
+	rc     int
+	reason string
+	hosts  []string
+}
+
+type byOutcome []*summaryLine
+
+func (s byOutcome) Len() int      { return len(s) }
+func (s byOutcome) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byOutcome) Less(i, j int) bool {
+	if s[i].rank != s[j].rank {
+		return s[i].rank < s[j].rank
+	}
+	if s[i].rc != s[j].rc {
+		return s[i].rc < s[j].rc
+	}
+	return s[i].reason < s[j].reason
+}
+
+// group hosts by exit code / failure reason, print a table of them to w and
+// return the aggregate exit status for the whole run. interrupted are the
+// hosts that had commands running when Ctrl-C was caught, the ones that had
+// to be killed are reported as interrupted rather than unreachable.
+func summarize(w io.Writer, results map[string]gdssh.Result, hosts []string, interrupted []string) int {
+	signalled := make(map[string]bool)
+	for _, host := range interrupted {
+		signalled[host] = true
+	}
+
+	groups := make(map[string]*summaryLine)
+	for _, host := range hosts {
+		res, ok := results[host]
+		status, ran := res.Value.(runStatus)
+		line := summaryLine{rc: gdssh.ExitConnLost}
+		if ran {
+			line.rc = status.rc
+		}
+
+		if !ok {
+			// never got to run (stopped rollout)
+			line.rank = exitFailed
+			line.reason = "no result"
+		} else if res.Err == gdssh.ErrTimeout {
+			// killed for running too long or stuck past --total-timeout
+			line.rank = exitFailed
+			line.reason = "timed out"
+		} else if errors.Is(res.Err, gdssh.ErrCancelled) {
+			// skipped after Ctrl-C
+			line.rank = exitFailed
+			line.reason = "cancelled"
+		} else if ran && status.rc != gdssh.ExitConnLost && status.signal != "" {
+			line.rank = exitFailed
+			line.reason = fmt.Sprintf("killed by SIG%s", status.signal)
+		} else if ran && status.rc != gdssh.ExitConnLost && status.rc != 0 {
+			line.rank = exitFailed
+			line.reason = fmt.Sprintf("exit %d", status.rc)
+		} else if errors.Is(res.Err, gdssh.ErrCheckFailed) {
+			// the command worked but the host didn't come back healthy
+			line.rank = exitFailed
+			line.reason = "health check failed"
+		} else if ran && status.rc == 0 {
+			line.rank = exitOk
+			line.reason = "ok"
+		} else if signalled[host] {
+			// still running after KillGrace, the kill leaves no exit status
+			line.rank = exitFailed
+			line.reason = "interrupted"
+		} else if remoteFailure(res.Err) {
+			line.rank = exitFailed
+			line.reason = hostless(res.Err)
+		} else {
+			line.rank = exitUnreachable
+			line.reason = fmt.Sprintf("unreachable: %s", hostless(res.Err))
+		}
+
+		if group, ok := groups[line.reason]; ok {
+			group.hosts = append(group.hosts, host)
+		} else {
+			line.hosts = []string{host}
+			groups[line.reason] = &line
+		}
+	}
+
+	lines := make(byOutcome, 0, len(groups))
+	for _, group := range groups {
+		sort.Strings(group.hosts)
+		lines = append(lines, group)
+	}
+	sort.Sort(lines)
+
+	status := exitOk
+	fmt.Fprintf(w, "\n%d hosts:\n", len(hosts))
+	for _, line := range lines {
+		fmt.Fprintf(w, "%6d  %-20s %s\n", len(line.hosts), line.reason, compactHosts(line.hosts))
+		if line.rank > status {
+			status = line.rank
+		}
+	}
+
+	return status
+}
+
 func RunRemote(opt GdshOptions) int {
 	padding := 1
+
+	// ask before connecting starts printing things
+	var sudo *gdssh.Password
+	if opt.SudoPass {
+		sudo = sudoPassword()
+		if _, err := sudo.Get(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	pool := sshPool(opt)
+	list := loadListByName(opt.List)
 
 	// find the longest hostname + 1 for formatting
-	for _, node := range loadListByName(opt.List) {
+	for _, node := range list {
 		if len(node.Address) >= padding {
 			padding = len(node.Address) + 1
 		}
@@ -88,9 +459,19 @@ func RunRemote(opt GdshOptions) int {
 		filename: fmt.Sprintf("/tmp/gdsh-script-%s-%d.sh", hostname, time.Now().Unix()),
 		script:   new(bytes.Buffer),
 		env:      opt.Env,
-		format:   fmt.Sprintf("%% %ds: %%s\n", padding),
-		rcodes:   make(map[string]int),
-		errors:   make(map[string]error),
+		format:   fmt.Sprintf("%% %ds: ", padding),
+		errfmt:   fmt.Sprintf("%% %ds! ", padding),
+		stderr:   opt.Stderr,
+		stream:   opt.Stream,
+		collate:  opt.Collate,
+		sudo:     sudo,
+	}
+
+	if opt.Tty {
+		rows, cols := ptySize(padding + 2)
+		run.pty = &gdssh.Pty{Term: os.Getenv("TERM"), Rows: rows, Cols: cols}
+	} else if opt.Stdin {
+		run.input = spoolStdin()
 	}
 
 	if opt.Command != "" {
@@ -105,10 +486,49 @@ func RunRemote(opt GdshOptions) int {
 		f.Close()
 	}
 
-	pool.All(&run)
-	pool.Close()
+	in := catchInterrupts(pool)
+	var rollErr error
+	var results map[string]gdssh.Result
+	if opt.Batch != "" {
+		rollout := gdssh.Rollout{
+			BatchSize:    batchSize(opt.Batch, len(list)),
+			CheckTimeout: time.Duration(opt.CheckTimeout) * time.Second,
+			MaxFailures:  opt.MaxFailures,
+		}
+		if opt.HealthCheck != "" {
+			rollout.Check = &checkTask{command: opt.HealthCheck, env: opt.Env}
+		}
+		results, rollErr = pool.Rolling(&run, rollout)
+	} else {
+		results = pool.All(&run)
+	}
+	in.done()
+	addUnreachable(results, pool.Unreachable())
+	closePool(pool)
+
+	if run.collate {
+		printCollated(os.Stdout, results)
+	}
 
-	return 1
+	hosts := make([]string, len(list))
+	for i, node := range list {
+		hosts[i] = node.Address
+	}
+
+	caught, interrupted := in.interrupted()
+	status := summarize(os.Stderr, results, hosts, interrupted)
+	if rollErr != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", rollErr)
+		if status == exitOk {
+			status = exitFailed
+		}
+	}
+
+	if caught {
+		fmt.Fprintf(os.Stderr, "Interrupted while running on: %s\n", compactHosts(interrupted))
+		status = exitInterrupted
+	}
+	return status
 }
 
 // vim: ts=4 sw=4 noet tw=120 softtabstop=4
@@ -14,6 +14,7 @@ import (
 type Node struct {
 	Address, Comment string
 	Port             int
+	Jump             string // from the last @jump line, empty to use ssh_config
 	rank             int
 }
 
@@ -74,19 +75,30 @@ func readList(path string) (list []Node) {
 
 	line, err := buf.ReadString('\n')
 	line_no := 1
+	jump := ""
 	for err != io.EOF {
 		var node Node
 
 		node.rank = line_no
 		parts := strings.SplitN(strings.Trim(line, "\n"), "#", 2)
 		dialaddr := strings.Trim(parts[0], " ")
+
+		// "@jump user@bastion" sends the nodes after it through a jump host, "@jump none" stops it
+		if strings.HasPrefix(dialaddr, "@jump") {
+			jump = strings.TrimSpace(dialaddr[5:])
+			line, err = buf.ReadString('\n')
+			line_no++
+			continue
+		}
+		node.Jump = jump
+
 		if strings.Contains(dialaddr, ":") {
 			np := strings.SplitN(dialaddr, ":", 2)
 			node.Address = np[0]
 			node.Port, _ = strconv.Atoi(np[1])
 		} else {
 			node.Address = strings.Trim(parts[0], " ")
-			node.Port = 22
+			node.Port = 0 // ssh_config or 22
 		}
 
 		if len(parts) == 2 {
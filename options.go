@@ -5,9 +5,11 @@ package main
 // really clunky to do some of the uglier bits of what gdsh needs
 
 import (
+	"./src/gdssh"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 )
 
@@ -20,14 +22,36 @@ type GdshOptions struct {
 	InclRe       string            // --include
 	ExclRe       string            // --exclude
 	Key          string            // --key/-i
-	User         string            // --user
+	User         string            // --user, otherwise ssh_config or the local user
 	Node         string            // --node/-h
 	Command      string            // --command/-c
 	Script       string            // --script/-s
 	BgJob        bool              // --background/-b
 	RemoteLog    string            // --remote-log/-r
 	RemoteScript string            // --remote-script-path
+	Stderr       string            // --stderr prefix|merge|hide|local
+	Stream       bool              // --stream
+	Collate      bool              // --collate
+	Tty          bool              // --tty/-t, also implied by --sudo-password
+	SudoPass     bool              // --sudo-password
+	Stdin        bool              // --stdin
+	Batch        string            // --batch N or N%
+	HealthCheck  string            // --health-check
+	CheckTimeout int               // --check-timeout seconds
+	MaxFailures  int               // --max-failures
 	Env          map[string]string // --env/-e key=val
+	Fanout       int               // --fanout N
+	ConnTimeout  int               // --connect-timeout seconds
+	CmdTimeout   int               // --timeout seconds
+	TotalTimeout int               // --total-timeout seconds
+	HostKeys     string            // --host-keys strict|accept-new|off
+	Jump         string            // --jump [user@]host[:port][,...]
+	ProxyCmd     string            // --proxy-command
+	Password     bool              // --password, also implied by --password-file
+	PasswordFile string            // --password-file
+	AgentLimit   int               // --agent-limit N concurrent ssh-agent signatures
+	Keepalive    int               // --keepalive seconds
+	ConnectWait  int               // --connect-wait seconds
 	Args         []string          // leftover arguments for subcommands
 }
 
@@ -55,6 +79,15 @@ func deleteArg(index int) (args []string, deleted string) {
 	return
 }
 
+// parse the value of a numeric option, which can't be negative
+func atoiOption(name string, value string) int {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Fatal(name, " requires a number >= 0, got '", value, "'")
+	}
+	return n
+}
+
 func parseArgs(args []string, command string) (opt GdshOptions) {
 	env := map[string]string{}
 
@@ -74,14 +107,20 @@ func parseArgs(args []string, command string) (opt GdshOptions) {
 		BgJob:        false,
 		RemoteLog:    "",
 		RemoteScript: "",
+		Stderr:       stderrPrefix,
+		Stream:       false,
+		Collate:      false,
+		Batch:        "",
+		HealthCheck:  "",
+		CheckTimeout: 300,
+		MaxFailures:  1,
 		Env:          env,
-	}
-
-	if opt.User == "" {
-		opt.User = UserIdToUsername(os.Geteuid())
-		if opt.User == "" {
-			log.Fatal("Could not determine username. Use --user or fix your /etc/passwd.")
-		}
+		Fanout:       0,
+		ConnTimeout:  30,
+		CmdTimeout:   0,
+		TotalTimeout: 0,
+		HostKeys:     gdssh.HostKeyStrict,
+		Keepalive:    15,
 	}
 
 	skip := true
@@ -126,6 +165,40 @@ func parseArgs(args []string, command string) (opt GdshOptions) {
 		case "--user":
 			opt.User = args[i+1]
 			skip = true
+		case "--fanout":
+			opt.Fanout = atoiOption(arg, args[i+1])
+			skip = true
+		case "--connect-timeout":
+			opt.ConnTimeout = atoiOption(arg, args[i+1])
+			skip = true
+		case "--total-timeout":
+			opt.TotalTimeout = atoiOption(arg, args[i+1])
+			skip = true
+		case "--host-keys":
+			opt.HostKeys = args[i+1]
+			skip = true
+		case "--jump", "-J":
+			opt.Jump = args[i+1]
+			skip = true
+		case "--proxy-command":
+			opt.ProxyCmd = args[i+1]
+			skip = true
+		case "--connect-wait":
+			opt.ConnectWait = atoiOption(arg, args[i+1])
+			skip = true
+		case "--keepalive":
+			opt.Keepalive = atoiOption(arg, args[i+1])
+			skip = true
+		case "--agent-limit":
+			opt.AgentLimit = atoiOption(arg, args[i+1])
+			skip = true
+		case "--password":
+			opt.Password = true
+			cont = true
+		case "--password-file":
+			opt.Password = true
+			opt.PasswordFile = args[i+1]
+			skip = true
 		case "--help":
 			printUsage()
 			os.Exit(0)
@@ -147,6 +220,40 @@ func parseArgs(args []string, command string) (opt GdshOptions) {
 			case "--background":
 				opt.BgJob = true
 				cont = true
+			case "--stderr":
+				opt.Stderr = args[i+1]
+				skip = true
+			case "--stream":
+				opt.Stream = true
+				cont = true
+			case "--collate":
+				opt.Collate = true
+				cont = true
+			case "--tty", "-t":
+				opt.Tty = true
+				cont = true
+			case "--sudo-password":
+				opt.Tty = true
+				opt.SudoPass = true
+				cont = true
+			case "--stdin":
+				opt.Stdin = true
+				cont = true
+			case "--batch":
+				opt.Batch = args[i+1]
+				skip = true
+			case "--health-check":
+				opt.HealthCheck = args[i+1]
+				skip = true
+			case "--check-timeout":
+				opt.CheckTimeout = atoiOption(arg, args[i+1])
+				skip = true
+			case "--max-failures":
+				opt.MaxFailures = atoiOption(arg, args[i+1])
+				skip = true
+			case "--timeout":
+				opt.CmdTimeout = atoiOption(arg, args[i+1])
+				skip = true
 			}
 		}
 
@@ -157,11 +264,35 @@ func parseArgs(args []string, command string) (opt GdshOptions) {
 		opt.Args = append(opt.Args, arg)
 	}
 
+	if opt.Jump != "" && opt.ProxyCmd != "" {
+		log.Fatal("--jump and --proxy-command are mutually exclusive!")
+	}
+
 	switch command {
 	case "run":
 		if opt.Command != "" && opt.Script != "" {
 			log.Fatal("--script/-s and --command/-c are mutually exclusive!")
 		}
+
+		if opt.HealthCheck != "" && opt.Batch == "" {
+			log.Fatal("--health-check only works with --batch")
+		}
+
+		if opt.Stream && opt.Collate {
+			log.Fatal("--stream and --collate are mutually exclusive!")
+		}
+
+		// the pty is where sudo reads the password, so there's no EOF to send
+		// at the end of the input and remote commands would wait forever
+		if opt.Stdin && opt.Tty {
+			log.Fatal("--stdin can't be used with --tty or --sudo-password")
+		}
+
+		switch opt.Stderr {
+		case stderrPrefix, stderrMerge, stderrHide, stderrLocal:
+		default:
+			log.Fatal("--stderr must be one of prefix, merge, hide or local, got '", opt.Stderr, "'")
+		}
 	}
 
 	return
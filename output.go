@@ -0,0 +1,185 @@
+// Copyright 2013 Albert P. Tobey. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"./src/gdssh"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// lineWriter collects output from one stream of one host and prints it with
+// the host prefix. In streaming mode complete lines are printed as soon as
+// they arrive and partial lines are held until the rest shows up, otherwise
+// everything is held until flush().
+type lineWriter struct {
+	out    io.Writer
+	prefix string      // printed in front of every line, usually the padded host
+	stream bool        // print complete lines as they arrive
+	lock   *sync.Mutex // shared by all hosts printing to out
+	buf    bytes.Buffer
+}
+
+func newLineWriter(out io.Writer, prefix string, stream bool, lock *sync.Mutex) *lineWriter {
+	return &lineWriter{
+		out:    out,
+		prefix: prefix,
+		stream: stream,
+		lock:   lock,
+	}
+}
+
+func (lw *lineWriter) Write(data []byte) (int, error) {
+	lw.buf.Write(data)
+
+	if lw.stream {
+		if i := bytes.LastIndex(lw.buf.Bytes(), []byte{'\n'}); i >= 0 {
+			lw.lock.Lock()
+			printLines(lw.out, lw.prefix, lw.buf.Next(i+1))
+			lw.lock.Unlock()
+		}
+	}
+
+	return len(data), nil
+}
+
+// print whatever is left in the buffer, the caller must hold the lock
+// buffered output has leading/trailing blank lines trimmed
+func (lw *lineWriter) flush() {
+	data := lw.buf.Bytes()
+	if !lw.stream {
+		data = bytes.Trim(data, "\r\n")
+	}
+	if len(data) > 0 {
+		printLines(lw.out, lw.prefix, data)
+	}
+	lw.buf.Reset()
+}
+
+// print each line of data to w with prefix in front of it
+func printLines(w io.Writer, prefix string, data []byte) {
+	data = bytes.TrimSuffix(data, []byte{'\n'})
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		fmt.Fprintf(w, "%s%s\n", prefix, bytes.TrimRight(line, "\r"))
+	}
+}
+
+// copy the command's stdout and stderr to the writers in the order the data
+// arrives until both channels are closed. Passing the same writer for both
+// merges the streams, a nil stderr discards it.
+func copyOutput(cmd *gdssh.SshCmd, stdout *lineWriter, stderr *lineWriter) {
+	outch, errch := cmd.Stdout, cmd.Stderr
+	for outch != nil || errch != nil {
+		select {
+		case data, ok := <-outch:
+			if !ok {
+				outch = nil // a nil channel is never selected
+				continue
+			}
+			stdout.Write(data)
+		case data, ok := <-errch:
+			if !ok {
+				errch = nil
+				continue
+			}
+			if stderr != nil {
+				stderr.Write(data)
+			}
+		}
+	}
+}
+
+// splits a hostname around its last number, e.g. node12.example.com
+var hostNumRe = regexp.MustCompile(`^(.*?)(\d+)(\D*)$`)
+
+// hostnames that differ only in their last number, e.g. node[1-3]
+type hostRange struct {
+	prefix, suffix string
+	nums           []string // kept as strings to preserve zero padding
+}
+
+type byNumber []string
+
+func (s byNumber) Len() int      { return len(s) }
+func (s byNumber) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byNumber) Less(i, j int) bool {
+	a, _ := strconv.Atoi(s[i])
+	b, _ := strconv.Atoi(s[j])
+	if a != b {
+		return a < b
+	}
+	return len(s[i]) < len(s[j])
+}
+
+// compactHosts squashes a host list into pdsh-style ranges, e.g.
+// node1 node2 node3 node7 web01 -> node[1-3,7],web01
+func compactHosts(hosts []string) string {
+	ranges := make(map[string]*hostRange)
+	var out []string
+
+	for _, host := range hosts {
+		m := hostNumRe.FindStringSubmatch(host)
+		if m == nil {
+			out = append(out, host)
+			continue
+		}
+
+		key := m[1] + "\x00" + m[3]
+		if hr, ok := ranges[key]; ok {
+			hr.nums = append(hr.nums, m[2])
+		} else {
+			ranges[key] = &hostRange{prefix: m[1], suffix: m[3], nums: []string{m[2]}}
+		}
+	}
+
+	for _, hr := range ranges {
+		if len(hr.nums) == 1 {
+			out = append(out, hr.prefix+hr.nums[0]+hr.suffix)
+			continue
+		}
+
+		sort.Sort(byNumber(hr.nums))
+		var spans []string
+		first, last := hr.nums[0], hr.nums[0]
+		for _, num := range hr.nums[1:] {
+			if consecutive(last, num) {
+				last = num
+				continue
+			}
+			spans = append(spans, span(first, last))
+			first, last = num, num
+		}
+		spans = append(spans, span(first, last))
+		out = append(out, fmt.Sprintf("%s[%s]%s", hr.prefix, strings.Join(spans, ","), hr.suffix))
+	}
+
+	sort.Strings(out)
+	return strings.Join(out, ",")
+}
+
+// true if b directly follows a without changing the zero padding, 09 -> 10 is fine, 9 -> 010 isn't
+func consecutive(a, b string) bool {
+	x, _ := strconv.Atoi(a)
+	y, _ := strconv.Atoi(b)
+	if y != x+1 {
+		return false
+	}
+	return len(a) == len(b) || (a[0] != '0' && b[0] != '0')
+}
+
+func span(first, last string) string {
+	if first == last {
+		return first
+	}
+	return first + "-" + last
+}
+
+// vim: ts=4 sw=4 noet tw=120 softtabstop=4
@@ -0,0 +1,96 @@
+// Copyright 2013 Albert P. Tobey. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"./src/gdssh"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// catches SIGINT/SIGTERM while a pool is running tasks and forwards them to the
+// remote commands. Commands still running after gdssh.KillGrace are killed and a
+// second signal exits immediately.
+type interrupter struct {
+	pool     *gdssh.Pool
+	signals  chan os.Signal
+	finished chan bool // closed by done()
+	lock     sync.Mutex
+	caught   bool
+	hosts    []string // hosts that had commands running when the signal came in
+}
+
+func catchInterrupts(pool *gdssh.Pool) *interrupter {
+	in := &interrupter{
+		pool:     pool,
+		signals:  make(chan os.Signal, 2),
+		finished: make(chan bool),
+	}
+	signal.Notify(in.signals, os.Interrupt, syscall.SIGTERM)
+	go in.watch()
+	return in
+}
+
+func (in *interrupter) watch() {
+	first := true
+	for sig := range in.signals {
+		if !first {
+			fmt.Fprintf(os.Stderr, "\nExiting without waiting for the remote commands.\n")
+			os.Exit(exitInterrupted)
+		}
+		first = false
+
+		remote := ssh.SIGINT
+		if sig == syscall.SIGTERM {
+			remote = ssh.SIGTERM
+		}
+
+		in.pool.Cancel()
+		hosts := in.pool.Signal(remote)
+
+		in.lock.Lock()
+		in.caught = true
+		in.hosts = hosts
+		in.lock.Unlock()
+
+		fmt.Fprintf(os.Stderr, "\nSent SIG%s to %d remote commands, waiting up to %s for them to exit. "+
+			"Interrupt again to exit now.\n", remote, len(hosts), gdssh.KillGrace)
+		go in.killAfter(gdssh.KillGrace)
+	}
+}
+
+func (in *interrupter) killAfter(grace time.Duration) {
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		if killed := in.pool.Kill(); len(killed) > 0 {
+			fmt.Fprintf(os.Stderr, "Killed remote commands still running on %s\n", compactHosts(killed))
+		}
+	case <-in.finished:
+	}
+}
+
+// call when the tasks are all done, stops the pending kill and signal handling
+func (in *interrupter) done() {
+	signal.Stop(in.signals)
+	close(in.signals)
+	close(in.finished)
+}
+
+// whether a signal was caught and which hosts were running commands at the time
+func (in *interrupter) interrupted() (bool, []string) {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	return in.caught, in.hosts
+}
+
+// vim: ts=4 sw=4 noet tw=120 softtabstop=4
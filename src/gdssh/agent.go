@@ -0,0 +1,127 @@
+// Copyright 2013 Albert P. Tobey. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gdssh
+
+import (
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+// Agent is one ssh-agent connection shared by many Conns instead of a socket
+// per host. It connects on first use and again after errors, and if there's
+// no agent to be had that auth method just fails and the next one is tried.
+type Agent struct {
+	Socket     string
+	MaxSigning int // concurrent signing requests, 0 for no limit, set before first use
+	client     agent.ExtendedAgent
+	sock       net.Conn
+	sem        chan bool
+	lock       sync.Mutex
+}
+
+var systemAgent *Agent
+var systemAgentOnce sync.Once
+
+func NewAgent(socket string) *Agent {
+	return &Agent{Socket: socket}
+}
+
+// SystemAgent returns the process-wide agent from $SSH_AUTH_SOCK, nil if there isn't one.
+func SystemAgent() *Agent {
+	systemAgentOnce.Do(func() {
+		if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+			systemAgent = NewAgent(sock)
+		}
+	})
+	return systemAgent
+}
+
+func (a *Agent) get() (agent.ExtendedAgent, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.client == nil {
+		sock, err := net.Dial("unix", a.Socket)
+		if err != nil {
+			return nil, fmt.Errorf("could not connect to ssh-agent at %s: %s", a.Socket, err)
+		}
+		a.sock = sock
+		a.client = agent.NewClient(sock)
+		if a.MaxSigning > 0 && a.sem == nil {
+			a.sem = make(chan bool, a.MaxSigning)
+		}
+	}
+
+	return a.client, nil
+}
+
+// drop a broken connection so the next request reconnects
+func (a *Agent) reset(client agent.ExtendedAgent) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.client == client {
+		a.sock.Close()
+		a.client = nil
+	}
+}
+
+// for ssh.PublicKeysCallback
+func (a *Agent) signers() ([]ssh.Signer, error) {
+	client, err := a.get()
+	if err != nil {
+		return nil, err
+	}
+
+	signers, err := client.Signers()
+	if err != nil {
+		a.reset(client)
+		return nil, fmt.Errorf("ssh-agent at %s: %s", a.Socket, err)
+	}
+
+	for i, signer := range signers {
+		if as, ok := signer.(ssh.AlgorithmSigner); ok {
+			signers[i] = &agentSigner{as, a}
+		}
+	}
+	return signers, nil
+}
+
+func (a *Agent) Close() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.client != nil {
+		a.sock.Close()
+		a.client = nil
+	}
+}
+
+// counts signing requests against MaxSigning, the agent does them one at a
+// time anyway but thousands of hosts waiting on it all at once can run past
+// their connect timeouts
+type agentSigner struct {
+	ssh.AlgorithmSigner
+	agent *Agent
+}
+
+func (s *agentSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	acquire(s.agent.sem)
+	defer release(s.agent.sem)
+	return s.AlgorithmSigner.Sign(rand, data)
+}
+
+func (s *agentSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	acquire(s.agent.sem)
+	defer release(s.agent.sem)
+	return s.AlgorithmSigner.SignWithAlgorithm(rand, data, algorithm)
+}
+
+// vim: ts=4 sw=4 noet tw=120 softtabstop=4
@@ -6,23 +6,52 @@ package gdssh
 
 import (
 	"bytes"
-	"code.google.com/p/go.crypto/ssh"
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
 	"io"
 	"log"
+	"sync"
+	"time"
 )
 
+const (
+	// rc reported when a command never produced an exit status, e.g. because the
+	// session couldn't be started or the connection dropped before the remote
+	// side sent exit-status / exit-signal
+	ExitConnLost = -1
+	// rc reported when a command was stopped for running past its timeout or deadline
+	ExitTimedOut = -2
+)
+
+// returned by Wait and Pool tasks when a command ran out of time
+var ErrTimeout = errors.New("timed out")
+
+// how long a timed out command gets to exit after SIGTERM before it's sent
+// SIGKILL and the session is torn down
+var KillGrace = 5 * time.Second
+
 type SshCmd struct {
-	Command string
-	Env     map[string]string
-	Stdin   chan []byte
-	Stdout  chan []byte
-	Stderr  chan []byte
-	stdin   io.Writer
-	stdout  io.Reader
-	stderr  io.Reader
-	running bool
-	conn    *Conn
-	session *ssh.Session
+	Command      string
+	Env          map[string]string
+	Timeout      time.Duration // maximum run time, 0 for no limit
+	Deadline     time.Time     // absolute time limit, zero for none
+	Pty          *Pty          // run it on a pseudo-terminal, nil for none
+	SudoPassword *Password     // answers sudo's password prompt, usually needs a Pty, see Start
+	Stdin        chan []byte
+	Stdout       chan []byte
+	Stderr       chan []byte
+	stdin        io.Writer
+	stdinLock    sync.Mutex // fwdStdin and watchSudo both write to stdin
+	sudoPrompt   string     // $SUDO_PROMPT, only this is answered with SudoPassword
+	sudoAnswered bool       // guarded by stdinLock
+	stdout       io.Reader
+	stderr       io.Reader
+	running      bool
+	exited       chan bool // closed when the session is over, stops fwdStdin
+	conn         *Conn
+	session      *ssh.Session
 }
 
 func (conn *Conn) Command(command string, env map[string]string) *SshCmd {
@@ -30,16 +59,38 @@ func (conn *Conn) Command(command string, env map[string]string) *SshCmd {
 		conn:    conn,
 		Command: command,
 		Env:     env,
+		Timeout: conn.CommandTimeout,
 		Stdin:   make(chan []byte),
 		Stdout:  make(chan []byte),
 		Stderr:  make(chan []byte),
+		exited:  make(chan bool),
 		running: false,
 	}
 }
 
+// CommandContext is Command with the Deadline set from ctx, e.g. the one a
+// ResultTask gets from All or Run, so the command stops when time is up.
+func (conn *Conn) CommandContext(ctx context.Context, command string, env map[string]string) *SshCmd {
+	cmd := conn.Command(command, env)
+	cmd.Deadline, _ = ctx.Deadline()
+	return cmd
+}
+
+// Start the command. With a SudoPassword, $SUDO_PROMPT is set to a new
+// random prompt for it first, which needs a POSIX shell on the remote side.
 func (cmd *SshCmd) Start() (err error) {
-	sess, err := cmd.conn.client.NewSession()
+	command := cmd.Command
+	if cmd.SudoPassword != nil {
+		if cmd.sudoPrompt, err = newSudoPrompt(); err != nil {
+			cmd.closeOutput()
+			return cmd.conn.hostError(ErrLocal, err)
+		}
+		command = sudoCommand(cmd.sudoPrompt, command)
+	}
+
+	sess, err := cmd.conn.session()
 	if err != nil {
+		cmd.closeOutput()
 		return
 	}
 
@@ -47,65 +98,145 @@ func (cmd *SshCmd) Start() (err error) {
 		sess.Setenv(k, v)
 	}
 
+	// get all the pipes before starting any forwarders so a failure here
+	// doesn't leave goroutines behind
 	if cmd.stdin, err = sess.StdinPipe(); err != nil {
-		log.Println("failed to acquire stdin pipe: %s", err)
-		return
+		err = cmd.conn.hostError(ErrRemote, fmt.Errorf("stdin pipe: %s", err))
+	} else if cmd.stdout, err = sess.StdoutPipe(); err != nil {
+		err = cmd.conn.hostError(ErrRemote, fmt.Errorf("stdout pipe: %s", err))
+	} else if cmd.stderr, err = sess.StderrPipe(); err != nil {
+		err = cmd.conn.hostError(ErrRemote, fmt.Errorf("stderr pipe: %s", err))
 	}
-	go cmd.fwdStdin()
-
-	if cmd.stdout, err = sess.StdoutPipe(); err != nil {
-		log.Println("failed to acquire stdout pipe: %s", err)
-		return
+	if err == nil && cmd.Pty != nil {
+		if err = cmd.Pty.request(sess); err != nil {
+			err = cmd.conn.hostError(ErrRemote, fmt.Errorf("pty request failed: %s", err))
+		}
 	}
-	go cmd.fwdStdout()
-
-	if cmd.stderr, err = sess.StderrPipe(); err != nil {
-		log.Println("failed to acquire stderr pipe: %s", err)
+	if err != nil {
+		sess.Close()
+		cmd.closeOutput()
 		return
 	}
+
+	go cmd.fwdStdin()
+	go cmd.fwdStdout()
 	go cmd.fwdStderr()
 
-	if err = sess.Start(cmd.Command); err != nil {
-		log.Printf("FAILED: '%s': %s\n", cmd.Command, err)
+	if err = sess.Start(command); err != nil {
+		err = cmd.conn.hostError(ErrRemote, fmt.Errorf("starting '%s': %s", cmd.Command, err))
+		sess.Close() // forwarders see EOF and close Stdout/Stderr
+		close(cmd.exited)
 		return
 	}
 
 	cmd.session = sess
 	cmd.running = true
+	cmd.conn.track(cmd)
 
 	return nil
 }
 
+// close the output channels when the forwarders never started so
+// Drain* callers don't block forever
+func (cmd *SshCmd) closeOutput() {
+	close(cmd.Stdout)
+	close(cmd.Stderr)
+}
+
 func (cmd *SshCmd) Running() bool {
 	return cmd.running
 }
 
-func (cmd *SshCmd) Wait() (rc int) {
-	err := cmd.session.Wait()
+// Wait for the remote command to exit. rc is the remote exit status and signal
+// is set to the signal name (e.g. "TERM") when the command was killed by one.
+// err is only non-nil when no exit status was received at all, in which case
+// rc is ExitConnLost and err is an ErrConnLost *HostError. Commands that outlive Timeout or Deadline are sent SIGTERM,
+// then SIGKILL after KillGrace, and return ExitTimedOut with ErrTimeout.
+func (cmd *SshCmd) Wait() (rc int, signal string, err error) {
+	defer close(cmd.exited)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.session.Wait()
+	}()
+
+	var expired <-chan time.Time
+	if limit, ok := cmd.timeLimit(); ok {
+		timer := time.NewTimer(limit)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case err = <-done:
+	case <-expired:
+		cmd.Signal(ssh.SIGTERM)
+		select {
+		case <-done:
+		case <-time.After(KillGrace):
+			cmd.Kill()
+			<-done
+		}
+		cmd.running = false
+		cmd.conn.untrack(cmd)
+		cmd.session.Close()
+		return ExitTimedOut, "", ErrTimeout
+	}
+
 	cmd.running = false
+	cmd.conn.untrack(cmd)
 	cmd.session.Close()
 	if err == nil {
-		return 0
+		return 0, "", nil
+	}
+
+	if exit, ok := err.(*ssh.ExitError); ok {
+		return exit.ExitStatus(), exit.Signal(), nil
+	}
+
+	// no exit status, the session or the whole connection went away
+	return ExitConnLost, "", cmd.conn.hostError(ErrConnLost, err)
+}
+
+// the time left before the command should be stopped, false if there's no limit
+func (cmd *SshCmd) timeLimit() (time.Duration, bool) {
+	if cmd.Timeout <= 0 && cmd.Deadline.IsZero() {
+		return 0, false
+	}
+
+	limit := cmd.Timeout
+	if !cmd.Deadline.IsZero() {
+		left := cmd.Deadline.Sub(time.Now())
+		if limit <= 0 || left < limit {
+			limit = left
+		}
+	}
+
+	if limit < 0 {
+		limit = 0
 	}
-	// TODO: figure out how to get at ExitError.Waitmsg
-	log.Printf("\nExit: %s\n", err)
-	return 1
+	return limit, true
 }
 
-func (cmd *SshCmd) Run() (rc int, err error) {
-	// TODO: get rc for return
+func (cmd *SshCmd) Run() (rc int, signal string, err error) {
 	if err = cmd.Start(); err != nil {
-		return
+		return ExitConnLost, "", err
 	}
 
-	rc = cmd.Wait()
-	return
+	return cmd.Wait()
 }
 
 func (cmd *SshCmd) Signal(sig ssh.Signal) error {
 	return cmd.session.Signal(sig)
 }
 
+// send SIGKILL and close the session, which makes Wait return even if the
+// server ignores signal requests (older OpenSSH does)
+func (cmd *SshCmd) Kill() {
+	cmd.session.Signal(ssh.SIGKILL)
+	cmd.session.Close()
+}
+
 func slurp(ch chan []byte) bytes.Buffer {
 	var buf bytes.Buffer
 	for data := range ch {
@@ -124,33 +255,58 @@ func (cmd *SshCmd) DrainStderr() bytes.Buffer {
 	return slurp(cmd.Stderr)
 }
 
+// runs until Stdin is closed or the command is over, whichever comes first.
+// Closing Stdin closes the remote stdin, so the command sees EOF.
 func (cmd *SshCmd) fwdStdin() {
+	broken := false
 	for {
-		data, ok := <-cmd.Stdin
-		if !ok {
-			break // channel closed, all done
-		}
-		wrote, err := cmd.stdin.Write(data)
-		if wrote != len(data) {
-			log.Panic("truncated write to stdin! (%d out of %d written)", wrote, len(data))
-		}
-		if err != nil {
-			log.Panic("Failed write: %s", err)
+		select {
+		case data, ok := <-cmd.Stdin:
+			if !ok {
+				cmd.stdinLock.Lock()
+				if closer, ok := cmd.stdin.(io.Closer); ok {
+					closer.Close()
+				}
+				cmd.stdinLock.Unlock()
+				return // channel closed, all done
+			}
+			// a short write always comes with an error. The remote end went
+			// away or closed stdin, Wait has the details, so just drop the
+			// rest so whoever is sending doesn't block.
+			if !broken && cmd.writeStdin(data) != nil {
+				broken = true
+			}
+		case <-cmd.exited:
+			return
 		}
 	}
 }
 
+func (cmd *SshCmd) writeStdin(data []byte) error {
+	cmd.stdinLock.Lock()
+	defer cmd.stdinLock.Unlock()
+	_, err := cmd.stdin.Write(data)
+	return err
+}
+
 func (cmd *SshCmd) fwdStdxxx(rd io.Reader, ch chan []byte, which string) {
-	buf := make([]byte, 1024)
+	var line []byte // for watchSudo
 	for {
+		// new buffer every time, the receiver may still be using the last one
+		buf := make([]byte, 1024)
 		read, err := rd.Read(buf)
+		if read > 0 {
+			if cmd.SudoPassword != nil {
+				line = cmd.watchSudo(line, buf[0:read])
+			}
+			ch <- buf[0:read]
+		}
 		if err == io.EOF {
 			break
 		} else if err != nil {
 			log.Printf("[%s] got %s on read\n", which, err)
 			break
 		}
-		ch <- buf[0:read]
 	}
 	close(ch)
 }
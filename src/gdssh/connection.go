@@ -8,243 +8,734 @@ package gdssh
 
 import (
 	"bufio"
-	"code.google.com/p/go.crypto/ssh"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"golang.org/x/crypto/ssh"
 	"io"
-	"log"
 	"net"
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 )
 
+// returned for sessions on a connection that is down
+var ErrNotConnected = errors.New("not connected")
+
+// what kind of failure a HostError is, test with errors.Is
+var (
+	ErrDial        = errors.New("could not connect")     // tcp, jump host, ProxyCommand or handshake timeout
+	ErrAuth        = errors.New("authentication failed") // no auth method was accepted
+	ErrHostKey     = errors.New("host key rejected")     // see HostKeyError
+	ErrKey         = errors.New("bad private key")       // --key, or every IdentityFile, couldn't be loaded
+	ErrConnLost    = errors.New("connection lost")       // keepalives went unanswered or retries ran out
+	ErrScpProtocol = errors.New("scp protocol error")    // scp said something unexpected or went away
+	ErrRemote      = errors.New("remote error")          // scp or the session failed on the remote side
+	ErrLocal       = errors.New("local error")           // the local file for scp couldn't be used
+)
+
+// HostError is a failure on one host, which is never a reason to stop the
+// others. Kind is one of the Err* values above, Err the underlying error.
+type HostError struct {
+	Host string
+	Kind error
+	Err  error
+}
+
+func (e *HostError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", e.Host, e.Kind, e.Err)
+}
+
+func (e *HostError) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *HostError) Unwrap() error {
+	return e.Err
+}
+
+func (conn *Conn) hostError(kind error, err error) *HostError {
+	return &HostError{Host: conn.Host, Kind: kind, Err: err}
+}
+
+// UnreachableError is returned for hosts that never connected, tasks aren't run on them.
+type UnreachableError struct {
+	Host string
+	Err  error // the last connect error
+}
+
+func (e *UnreachableError) Error() string {
+	if _, ok := e.Err.(*HostError); ok {
+		return fmt.Sprintf("unreachable: %s", e.Err) // already has the host
+	}
+	return fmt.Sprintf("%s: unreachable: %s", e.Host, e.Err)
+}
+
+func (e *UnreachableError) Unwrap() error {
+	return e.Err
+}
+
+func (conn *Conn) unreachable() *UnreachableError {
+	err := conn.LastError()
+	if err == nil {
+		err = ErrNotConnected
+	}
+	return &UnreachableError{Host: conn.Host, Err: err}
+}
+
 type Conn struct {
-	Host      string
-	Port      int
-	User      string
-	Key       string
-	Retries   int
-	Started   time.Time // last time the connection was made, reset by each retry
-	connected bool      // for tracking whether the connection is alive
-	done      chan bool // for notifying goroutines to stop retrying
-	address   string    // host:port formatted connection address
-	netconn   net.Conn
-	config    *ssh.ClientConfig
-	client    *ssh.ClientConn
+	Host           string
+	HostName       string // the name or address to connect to, Host unless ssh_config says otherwise
+	Port           int
+	User           string
+	Key            string
+	IdentityFiles  []string            // more keys from ssh_config, missing files are skipped
+	HostKeys       ssh.HostKeyCallback // nil accepts any host key, see KnownHosts.Checker
+	HostKeyAlgos   []string            // host key algorithms to ask for, see KnownHosts.Algorithms
+	Jump           *Conn               // connect through this jump host, see SshConfig.JumpHost
+	ProxyCommand   string              // connect through this command's stdin/stdout, %h %p %r %n are expanded
+	Password       *Password           // password/keyboard-interactive auth after keys, nil for keys only
+	Agent          *Agent              // nil for SystemAgent()
+	Retries        int
+	Started        time.Time     // last time the connection was made, reset by each retry
+	ConnectTimeout time.Duration // tcp connect + ssh handshake, 0 for no limit
+	CommandTimeout time.Duration // copied to every SshCmd created with Command(), 0 for no limit
+	connected      bool          // for tracking whether the connection is alive
+	done           chan bool     // closed by stop() to tell the pool's goroutines to stop retrying
+	stopOnce       sync.Once     // for stop()
+	address        string        // host:port formatted connection address
+	netconn        net.Conn
+	config         *ssh.ClientConfig
+	client         *ssh.Client
+	cmds           map[*SshCmd]bool // commands currently running, for Signal/Kill
+	cmdlock        sync.Mutex
+	state          sync.Mutex // for connected, netconn, client and lastErr
+	lastErr        error      // from the last failed connect
+	up             chan bool  // closed while connected, for WaitAlive
+	jumplock       sync.Mutex // serializes connecting when used as a jump host
+	jumpErr        error      // last failed connect as a jump host, returned until jumpRetry
+	jumpRetry      time.Time
 }
 
+// how long a jump host that failed to connect is left alone, so a few hundred
+// nodes behind a dead bastion don't each wait for their own connect timeout
+var JumpRetry = 5 * time.Second
+
 func NewConn(host string, port int, user string, key string) (conn *Conn) {
+	if port == 0 {
+		port = 22
+	}
+
 	return &Conn{
 		Host:      host,
+		HostName:  host,
 		Port:      port,
 		User:      user,
 		Key:       key,
 		Retries:   0,
 		connected: false,
 		done:      make(chan bool),
+		up:        make(chan bool),
 		address:   fmt.Sprintf("%s:%d", host, port),
+		cmds:      make(map[*SshCmd]bool),
 	}
 }
 
 func (conn *Conn) Connect() error {
-	var auth []ssh.ClientAuth
+	return conn.connectContext(context.Background())
+}
+
+// Connect, giving up once ctx is done
+func (conn *Conn) connectContext(ctx context.Context) error {
+	var auth []ssh.AuthMethod
+	var keyErr error
 
 	// only load a private key if requested ~/.ssh/id_rsa is _not_ loaded automatically
 	// ssh-agent should be the usual path
 	if conn.Key != "" {
-		kr := new(keyring)
-		if err := kr.loadPEM(conn.Key); err != nil {
-			log.Fatal("Couldn't load specified private key '", conn.Key, "': ", err)
+		signer, err := keys.load(conn.Key)
+		if err != nil {
+			keyErr = err
+		} else {
+			auth = append(auth, ssh.PublicKeys(signer))
 		}
-		auth = append(auth, ssh.ClientAuthKeyring(kr))
 	}
 
-	agentSock := os.Getenv("SSH_AUTH_SOCK")
-
-	// ssh-agent support, might need to reuse this in the future?
-	// how bad are 100's or 1000's of connections to the agent?
-	if agentSock != "" {
-		sock, err := net.Dial("unix", agentSock)
+	// ssh ignores IdentityFiles that don't exist and skips the ones it can't
+	// use, e.g. encrypted ones with nobody to ask for the passphrase or sk-*
+	// keys, so do the same
+	var signers []ssh.Signer
+	var skipped error
+	for _, file := range conn.IdentityFiles {
+		if _, err := os.Stat(file); err != nil {
+			continue
+		}
+		signer, err := keys.load(file)
 		if err != nil {
-			log.Fatal("Could not connect to SSH_AUTH_SOCK. Is ssh-agent running?")
+			keys.skip(file, err)
+			skipped = err
+			continue
 		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+
+	// ssh-agent, one connection shared by everybody instead of one per host
+	ag := conn.Agent
+	if ag == nil {
+		ag = SystemAgent()
+	}
+	if ag != nil {
+		auth = append(auth, ssh.PublicKeysCallback(ag.signers))
+	}
+
+	// servers try methods in this order, so keys always go first
+	if conn.Password != nil {
+		auth = append(auth, conn.Password.authMethods()...)
+	}
 
-		agent := ssh.NewAgentClient(sock)
-		auth = append(auth, ssh.ClientAuthAgent(agent))
+	hostKeys := conn.HostKeys
+	if hostKeys == nil {
+		hostKeys = ssh.InsecureIgnoreHostKey()
 	}
 
 	conn.config = &ssh.ClientConfig{
-		User: conn.User,
-		Auth: auth,
+		User:              conn.User,
+		Auth:              auth,
+		HostKeyCallback:   hostKeys,
+		HostKeyAlgorithms: conn.HostKeyAlgos,
+	}
+
+	// unusable IdentityFiles only matter when there's nothing else to try
+	if keyErr == nil && len(auth) == 0 && skipped != nil {
+		keyErr = skipped
+	}
+
+	// not before the config is set, Reconnect uses it
+	if keyErr != nil {
+		return conn.setLastError(conn.hostError(ErrKey, keyErr))
 	}
 
-	return conn.connect()
+	return conn.connect(ctx)
 }
 
-func (conn *Conn) connect() (err error) {
-	if conn.connected {
+func (conn *Conn) connect(ctx context.Context) (err error) {
+	if conn.Alive() {
 		panic("BUG: connect() called on connected socket/client!")
 	}
 
+	// keep the error around for UnreachableError
+	defer func() {
+		if err != nil {
+			err = conn.setLastError(conn.connectError(err))
+		}
+	}()
+
+	// ConnectTimeout is for the whole thing, and Close has to be able to
+	// interrupt it instead of waiting for a host that may never answer
+	ctx, cancel := conn.context(ctx)
+	defer cancel()
+	if conn.ConnectTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, conn.ConnectTimeout)
+		defer cancelTimeout()
+	}
+
 	// dial manually so the tcp socket can be closed directly since it's hidden
 	// if you use ssh.Dial, might also be handy for tuning?
-	conn.netconn, err = net.Dial("tcp", conn.address)
+	var nc net.Conn
+	if conn.Jump != nil {
+		nc, err = conn.Jump.dial(ctx, conn.address)
+	} else if conn.ProxyCommand != "" {
+		nc, err = dialProxy(conn.proxyCommand())
+	} else {
+		var dialer net.Dialer
+		nc, err = dialer.DialContext(ctx, "tcp", conn.address)
+	}
 	if err != nil {
-		conn.connected = false
+		if ctx.Err() != nil && conn.Jump == nil {
+			err = conn.interrupted(ctx, "connect") // the jump host already says what happened
+		}
 		return
 	}
 
-	conn.client, err = ssh.Client(conn.netconn, conn.config)
+	// a host that accepts the tcp connection but never finishes the handshake
+	// would otherwise hang here forever. Closing the connection is the only way
+	// to stop the handshake and it works the same for jump hosts and ProxyCommands.
+	handshook := make(chan bool)
+	go func() {
+		select {
+		case <-ctx.Done():
+			nc.Close()
+		case <-handshook:
+		}
+	}()
+
+	sshconn, chans, reqs, err := ssh.NewClientConn(nc, conn.address, conn.config)
+	close(handshook)
 	if err != nil {
-		conn.connected = false
+		nc.Close()
+		if ctx.Err() != nil {
+			err = conn.interrupted(ctx, "ssh handshake")
+		}
 		return
 	}
+	client := ssh.NewClient(sshconn, chans, reqs)
 
-	conn.Started = time.Now()
+	conn.state.Lock()
+	if conn.stopped() {
+		conn.state.Unlock()
+		client.Close()
+		return conn.interrupted(ctx, "connect")
+	}
+	conn.netconn = nc
+	conn.client = client
 	conn.connected = true
+	conn.Started = time.Now()
+	close(conn.up)
+	conn.state.Unlock()
+
+	// notice right away when the other end goes away, keepalives are for
+	// the cases where it goes quiet instead
+	go func() {
+		client.Wait()
+		conn.drop(client)
+	}()
 
 	return
 }
 
+// a context that's also done once the connection is stopped
+func (conn *Conn) context(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		select {
+		case <-conn.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// why connecting stopped at what, once ctx is done
+func (conn *Conn) interrupted(ctx context.Context, what string) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s: %s %s", conn.address, what, ErrTimeout)
+	}
+	return fmt.Errorf("%s: %s %s", conn.address, what, ErrCancelled)
+}
+
+// sort a failed connect into ErrHostKey, ErrAuth or ErrDial
+func (conn *Conn) connectError(err error) *HostError {
+	var hke *HostKeyError
+	if errors.As(err, &hke) {
+		return conn.hostError(ErrHostKey, err)
+	}
+	// x/crypto/ssh doesn't have an error type for this one
+	if strings.Contains(err.Error(), "unable to authenticate") {
+		return conn.hostError(ErrAuth, err)
+	}
+	return conn.hostError(ErrDial, err)
+}
+
+// failures that retrying won't fix
+func permanent(err error) bool {
+	return errors.Is(err, ErrKey) || errors.Is(err, ErrAuth) || errors.Is(err, ErrHostKey)
+}
+
+func (conn *Conn) setLastError(err *HostError) error {
+	conn.state.Lock()
+	conn.lastErr = err
+	conn.state.Unlock()
+	return err
+}
+
+// open a tcp connection to addr from the remote side, for using this
+// connection as a jump host. Connects first if needed.
+func (conn *Conn) dial(ctx context.Context, addr string) (net.Conn, error) {
+	conn.jumplock.Lock()
+	client := conn.current()
+	if client == nil {
+		if time.Now().Before(conn.jumpRetry) {
+			conn.jumplock.Unlock()
+			return nil, conn.jumpErr
+		}
+		if err := conn.connectContext(ctx); err != nil {
+			err = fmt.Errorf("jump host %s", err) // err has the host already
+			// a node that was closed while waiting says nothing about the jump host
+			if ctx.Err() != context.Canceled {
+				conn.jumpErr = err
+				conn.jumpRetry = time.Now().Add(JumpRetry)
+			}
+			conn.jumplock.Unlock()
+			return nil, err
+		}
+		client = conn.current()
+	}
+	conn.jumplock.Unlock()
+
+	// a blackholed node would otherwise take the bastion's tcp timeout, which
+	// ConnectTimeout knows nothing about. A channel that opens too late is closed.
+	nc, err := client.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("jump host %s: dial %s %s", conn.address, addr, ctxError(ctx))
+		}
+		return nil, fmt.Errorf("jump host %s: %s", conn.address, err)
+	}
+	return nc, nil
+}
+
 func (conn *Conn) Reconnect() error {
 	conn.Close()
-	return conn.connect()
+	return conn.connect(context.Background())
 }
 
-// TODO: some kind of keepalive, possibly open & close ssh channels
+// Alive is true from a successful connect until the connection is closed, the
+// other end goes away or it stops answering keepalives.
 func (conn *Conn) Alive() bool {
+	conn.state.Lock()
+	defer conn.state.Unlock()
 	return conn.connected
 }
 
-func (conn *Conn) Close() {
-	// TODO: watch for memory leaks on long-running programs in case
-	// ssh.Client() doesn't have a Close()
-	conn.netconn.Close() // close the underlying TCP connection, ignore errors
+// WaitAlive waits up to timeout for the connection to be up, e.g. while the
+// pool is reconnecting it, or until the pool gives up on it. Returns whether it is.
+func (conn *Conn) WaitAlive(timeout time.Duration) bool {
+	conn.state.Lock()
+	up := conn.up
+	conn.state.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-up:
+		return true
+	case <-timer.C:
+	case <-conn.done:
+	}
+	return conn.Alive()
+}
+
+// when the connection was last made, zero if never
+func (conn *Conn) started() time.Time {
+	conn.state.Lock()
+	defer conn.state.Unlock()
+	return conn.Started
+}
+
+// the error from the last failed connect, nil if there wasn't one
+func (conn *Conn) LastError() error {
+	conn.state.Lock()
+	defer conn.state.Unlock()
+	return conn.lastErr
+}
+
+// the client if connected, nil otherwise
+func (conn *Conn) current() *ssh.Client {
+	conn.state.Lock()
+	defer conn.state.Unlock()
+	if !conn.connected {
+		return nil
+	}
+	return conn.client
+}
+
+// new session on the current client, fails instead of panicking while disconnected
+func (conn *Conn) session() (*ssh.Session, error) {
+	client := conn.current()
+	if client == nil {
+		return nil, conn.hostError(ErrConnLost, ErrNotConnected)
+	}
+	sess, err := client.NewSession()
+	if err != nil {
+		return nil, conn.hostError(ErrRemote, err)
+	}
+	return sess, nil
+}
+
+// Ping sends a keepalive@openssh.com request and waits up to timeout for the
+// reply. Servers answer it with a failure, any answer at all means it's alive.
+func (conn *Conn) Ping(timeout time.Duration) error {
+	client := conn.current()
+	if client == nil {
+		return ErrNotConnected
+	}
+
+	reply := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		reply <- err
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-reply:
+		return err
+	case <-timer.C:
+		return ErrTimeout
+	}
+}
+
+// mark the connection dead if client is still the current one, commands on
+// it fail and the pool's monitor takes care of reconnecting
+func (conn *Conn) drop(client *ssh.Client) {
+	conn.state.Lock()
+	defer conn.state.Unlock()
+	if conn.client == client {
+		conn.disconnect()
+	}
+}
+
+// the caller must hold conn.state
+func (conn *Conn) disconnect() {
+	if conn.netconn != nil {
+		conn.netconn.Close() // close the underlying TCP connection, ignore errors
+	}
+	if conn.connected {
+		conn.up = make(chan bool)
+	}
 	conn.connected = false
+	conn.netconn = nil
 	conn.client = nil
 }
 
-// scp a buffer to a file on the remote machine
-func (conn *Conn) ScpBuf(buf []byte, mode string, remoteFile string) {
-	sess, err := conn.client.NewSession()
-	if err != nil {
-		log.Fatal("[", conn.Host, "] session creation failed: ", err)
+// whether stop() was called
+func (conn *Conn) stopped() bool {
+	select {
+	case <-conn.done:
+		return true
+	default:
+		return false
 	}
-	defer sess.Close()
+}
 
-	stdin, _ := sess.StdinPipe()
-	stdout, _ := sess.StdoutPipe()
-	//stderr, _ := sess.StderrPipe()
+// tell the pool's goroutines for this connection to stop for good, unlike
+// Close which the pool follows with a reconnect. A connect in progress is
+// interrupted.
+func (conn *Conn) stop() {
+	conn.stopOnce.Do(func() {
+		if conn.done != nil {
+			close(conn.done)
+		}
+	})
+}
 
-	cmd := fmt.Sprintf("/usr/bin/scp -t -- %s", remoteFile)
-	if err := sess.Start(cmd); err != nil {
-		log.Fatal("[", conn.address, "] command failed: ", err)
+func (conn *Conn) track(cmd *SshCmd) {
+	conn.cmdlock.Lock()
+	conn.cmds[cmd] = true
+	conn.cmdlock.Unlock()
+}
+
+func (conn *Conn) untrack(cmd *SshCmd) {
+	conn.cmdlock.Lock()
+	delete(conn.cmds, cmd)
+	conn.cmdlock.Unlock()
+}
+
+func (conn *Conn) running() []*SshCmd {
+	conn.cmdlock.Lock()
+	defer conn.cmdlock.Unlock()
+	cmds := make([]*SshCmd, 0, len(conn.cmds))
+	for cmd := range conn.cmds {
+		cmds = append(cmds, cmd)
 	}
+	return cmds
+}
 
-	stdin.Write([]byte(fmt.Sprintf("C%s %d %s\n", mode, len(buf), path.Base(remoteFile))))
-	response := make([]byte, 1, 1)
-	stdout.Read(response)
-	stdin.Write(buf)
-	stdin.Close()
-	// TODO: pull back stdout / stderr for errors
-	err = sess.Wait()
+// send a signal to every command running on this connection, returns how many there were
+func (conn *Conn) Signal(sig ssh.Signal) int {
+	cmds := conn.running()
+	for _, cmd := range cmds {
+		cmd.Signal(sig)
+	}
+	return len(cmds)
+}
+
+// kill every command running on this connection, returns how many there were
+func (conn *Conn) Kill() int {
+	cmds := conn.running()
+	for _, cmd := range cmds {
+		cmd.Kill()
+	}
+	return len(cmds)
+}
+
+func (conn *Conn) Close() {
+	conn.state.Lock()
+	defer conn.state.Unlock()
+	conn.disconnect()
 }
 
-func (conn *Conn) ScpPush(localFile string, remoteFile string) {
+// scp a buffer to a file on the remote machine
+func (conn *Conn) ScpBuf(buf []byte, mode string, remoteFile string) error {
+	return conn.scpSend(bytes.NewReader(buf), int64(len(buf)), mode, remoteFile)
+}
+
+func (conn *Conn) ScpPush(localFile string, remoteFile string) error {
 	f, err := os.Open(localFile)
 	if err != nil {
-		log.Fatal("Could not read local file '", localFile, "': ", err)
+		return conn.hostError(ErrLocal, err)
 	}
 	defer f.Close()
+
 	fi, err := f.Stat()
+	if err != nil {
+		return conn.hostError(ErrLocal, err)
+	}
 
-	sess, err := conn.client.NewSession()
+	return conn.scpSend(f, fi.Size(), fmt.Sprintf("%04o", fi.Mode().Perm()), remoteFile)
+}
+
+// the sending side of scp -t: wait for the remote to be ready, then send the
+// header and the data, checking the acknowledgement after each
+func (conn *Conn) scpSend(data io.Reader, size int64, mode string, remoteFile string) error {
+	sess, err := conn.session()
 	if err != nil {
-		log.Fatal("[", conn.Host, "] session creation failed: ", err)
+		return err
 	}
 	defer sess.Close()
 
 	stdin, _ := sess.StdinPipe()
 	stdout, _ := sess.StdoutPipe()
+	var stderr bytes.Buffer
+	sess.Stderr = &stderr
 
 	cmd := fmt.Sprintf("/usr/bin/scp -t -- %s", remoteFile)
-
 	if err := sess.Start(cmd); err != nil {
-		log.Fatal("[", conn.address, "] command failed: ", err)
+		return conn.hostError(ErrRemote, err)
 	}
 
-	mode := fi.Mode().Perm()
-	size := fi.Size()
-	base := path.Base(remoteFile)
+	acks := bufio.NewReader(stdout)
+	if err := conn.scpAck(acks, &stderr); err != nil {
+		return err
+	}
 
-	stdin.Write([]byte(fmt.Sprintf("C%04o %d %s\n", mode, size, base)))
-	response := make([]byte, 1, 1)
-	stdout.Read(response)
-	io.Copy(stdin, f)
-	stdin.Close()
-	err = sess.Wait()
-}
+	fmt.Fprintf(stdin, "C%s %d %s\n", mode, size, path.Base(remoteFile))
+	if err := conn.scpAck(acks, &stderr); err != nil {
+		return err
+	}
 
-func (conn *Conn) ScpPull(localFile string, remoteFile string) {
-	// overwrite in place, no tempfiles for now
-	f, err := os.Create(localFile)
-	if err != nil {
-		log.Fatal("Could not open local file '", localFile, "' for writing: ", err)
+	if written, err := io.CopyN(stdin, data, size); err != nil {
+		return conn.hostError(ErrScpProtocol, fmt.Errorf("sent %d/%d bytes: %s", written, size, err))
 	}
+	stdin.Write([]byte{0})
+	if err := conn.scpAck(acks, &stderr); err != nil {
+		return err
+	}
+	stdin.Close()
 
-	sess, err := conn.client.NewSession()
+	return conn.scpWait(sess, &stderr)
+}
+
+func (conn *Conn) ScpPull(localFile string, remoteFile string) error {
+	sess, err := conn.session()
 	if err != nil {
-		log.Fatal("[", conn.Host, "] session creation failed: ", err)
+		return err
 	}
 	defer sess.Close()
 
 	stdin, _ := sess.StdinPipe()
 	stdout, _ := sess.StdoutPipe()
+	var stderr bytes.Buffer
+	sess.Stderr = &stderr
 
 	cmd := fmt.Sprintf("/usr/bin/scp -f -- %s", remoteFile)
 	if err := sess.Start(cmd); err != nil {
-		log.Fatal("[", conn.address, "] command failed: ", err)
+		return conn.hostError(ErrRemote, err)
 	}
 
-	stdin.Write([]byte{0}) // ack
+	stdin.Write([]byte{0}) // ready
 
+	// skip the T (timestamp) line if there is one, we only care about the
+	// C line with the mode/size/name
 	var mode int
 	var size int64
 	var name string
 	bs := bufio.NewReader(stdout)
 	for {
 		line, err := bs.ReadString('\n')
-		stdin.Write([]byte{0}) // ack every message
 		if err != nil {
-			fmt.Printf("BUG: %s\n", err)
-			break
+			return conn.scpError(err, &stderr)
 		}
-		// for now, we only care about the final line with filename/mode/size
-		if strings.HasPrefix(line, "C") {
-			_, err := fmt.Sscanf(line, "C%04o %d %s\n", &mode, &size, &name)
-			if err != nil {
-				fmt.Printf("BUG: %s\n", err)
-				break
+
+		switch line[0] {
+		case 'T':
+			stdin.Write([]byte{0})
+			continue
+		case 'C':
+			if _, err := fmt.Sscanf(line, "C%o %d %s\n", &mode, &size, &name); err != nil {
+				return conn.hostError(ErrScpProtocol, fmt.Errorf("bad header '%s': %s", strings.TrimSpace(line), err))
 			}
-			break
-		} else {
-			fmt.Printf("ignoring: '%s'\n", line)
+		case 1, 2:
+			return conn.hostError(ErrRemote, errors.New(strings.TrimSpace(line[1:])))
+		default:
+			return conn.hostError(ErrScpProtocol, fmt.Errorf("unexpected '%s'", strings.TrimSpace(line)))
 		}
+		break
 	}
 
-	written, err := io.CopyN(f, bs, size)
+	// overwrite in place, no tempfiles for now. Not created until now so a
+	// missing remote file doesn't leave an empty local one behind.
+	f, err := os.Create(localFile)
 	if err != nil {
-		fmt.Printf("BUG(%d/%d bytes): %s\n", written, size, err)
+		return conn.hostError(ErrLocal, err)
 	}
+	defer f.Close()
 
+	stdin.Write([]byte{0}) // send the data
+	if written, err := io.CopyN(f, bs, size); err != nil {
+		return conn.hostError(ErrScpProtocol, fmt.Errorf("received %d/%d bytes: %s", written, size, err))
+	}
+	if err := conn.scpAck(bs, &stderr); err != nil {
+		return err
+	}
 	stdin.Write([]byte{0}) // ack the data
-
 	stdin.Close()
-	err = sess.Wait()
+
+	return conn.scpWait(sess, &stderr)
+}
+
+// read an scp acknowledgement: 0 for ok, 1 (warning) or 2 (error) followed by a message
+func (conn *Conn) scpAck(acks *bufio.Reader, stderr *bytes.Buffer) error {
+	ack, err := acks.ReadByte()
 	if err != nil {
-		fmt.Printf("BUG(%d/%d bytes): %s\n", written, size, err)
+		return conn.scpError(err, stderr)
+	}
+
+	switch ack {
+	case 0:
+		return nil
+	case 1, 2:
+		msg, _ := acks.ReadString('\n')
+		return conn.hostError(ErrRemote, errors.New(strings.TrimSpace(msg)))
+	}
+	return conn.hostError(ErrScpProtocol, fmt.Errorf("unexpected acknowledgement %d", ack))
+}
+
+// scp went away in the middle of things, usually it said why on stderr
+func (conn *Conn) scpError(err error, stderr *bytes.Buffer) error {
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return conn.hostError(ErrRemote, errors.New(msg))
+	}
+	return conn.hostError(ErrScpProtocol, err)
+}
+
+func (conn *Conn) scpWait(sess *ssh.Session, stderr *bytes.Buffer) error {
+	if err := sess.Wait(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%s: %s", err, msg)
+		}
+		return conn.hostError(ErrRemote, err)
 	}
+	return nil
 }
 
 // vim: ts=4 sw=4 noet tw=120 softtabstop=4
@@ -0,0 +1,183 @@
+// Copyright 2013 Albert P. Tobey. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gdssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"testing"
+)
+
+// an in-process ssh server that lets anybody in, or nobody with refuse set,
+// and answers keepalives but refuses to run anything in its sessions
+type testServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	hostKey  ssh.PublicKey
+	conns    map[net.Conn]bool
+	lock     sync.Mutex
+	wg       sync.WaitGroup
+}
+
+func newTestServer(t *testing.T, refuse bool) *testServer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{NoClientAuth: !refuse}
+	if refuse {
+		config.PasswordCallback = func(c ssh.ConnMetadata, pw []byte) (*ssh.Permissions, error) {
+			return nil, errors.New("refused")
+		}
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &testServer{listener: listener, config: config, hostKey: signer.PublicKey(), conns: make(map[net.Conn]bool)}
+	srv.wg.Add(1)
+	go srv.serve()
+	t.Cleanup(srv.close)
+	return srv
+}
+
+func (srv *testServer) serve() {
+	defer srv.wg.Done()
+	for {
+		nc, err := srv.listener.Accept()
+		if err != nil {
+			return
+		}
+		srv.lock.Lock()
+		srv.conns[nc] = true
+		srv.lock.Unlock()
+
+		srv.wg.Add(1)
+		go srv.handle(nc)
+	}
+}
+
+func (srv *testServer) handle(nc net.Conn) {
+	defer srv.wg.Done()
+	defer nc.Close()
+
+	_, chans, reqs, err := ssh.NewServerConn(nc, srv.config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nch := range chans {
+		if nch.ChannelType() != "session" {
+			nch.Reject(ssh.UnknownChannelType, "sessions only")
+			continue
+		}
+		ch, reqs, err := nch.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			ssh.DiscardRequests(reqs) // exec, env etc. all get a no
+			ch.Close()
+		}()
+	}
+}
+
+func (srv *testServer) close() {
+	srv.listener.Close()
+	srv.lock.Lock()
+	for nc := range srv.conns {
+		nc.Close()
+	}
+	srv.lock.Unlock()
+	srv.wg.Wait()
+}
+
+// a connection to the server that doesn't go near the user's agent or keys
+func (srv *testServer) conn(key string) *Conn {
+	addr := srv.listener.Addr().(*net.TCPAddr)
+	conn := NewConn(addr.IP.String(), addr.Port, "test", key)
+	conn.Agent = NewAgent("/nonexistent")
+	return conn
+}
+
+func TestReconnectAfterBadKey(t *testing.T) {
+	srv := newTestServer(t, false)
+
+	key := path.Join(t.TempDir(), "id_bad")
+	if err := ioutil.WriteFile(key, []byte("not a key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := srv.conn(key)
+	if err := conn.Connect(); !errors.Is(err, ErrKey) {
+		t.Fatalf("expected ErrKey from Connect, got %v", err)
+	}
+
+	// the pool's monitor used to do this with a nil config and crash
+	conn.Reconnect()
+	conn.Close()
+}
+
+func TestReconnectGivesUpOnAuth(t *testing.T) {
+	srv := newTestServer(t, true)
+
+	pool := NewPool()
+	pool.RetryInterval = 0
+	pool.MaxRetries = 5
+
+	conn := srv.conn("")
+	if err := conn.Connect(); !errors.Is(err, ErrAuth) {
+		t.Fatalf("expected ErrAuth from Connect, got %v", err)
+	}
+
+	if pool.reconnect(conn) {
+		t.Fatal("reconnect succeeded with a refused login")
+	} else if conn.Retries != 1 {
+		t.Fatalf("expected 1 retry for a refused login, got %d", conn.Retries)
+	}
+}
+
+func TestCommandRefused(t *testing.T) {
+	srv := newTestServer(t, false)
+
+	conn := srv.conn("")
+	if err := conn.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	cmd := conn.Command("true", nil)
+	go cmd.DrainStdout()
+	go cmd.DrainStderr()
+	rc, _, err := cmd.Run()
+	var he *HostError
+	if !errors.Is(err, ErrRemote) || !errors.As(err, &he) || he.Host != conn.Host {
+		t.Fatalf("expected an ErrRemote *HostError for a refused exec, got %v", err)
+	} else if rc != ExitConnLost {
+		t.Fatalf("expected rc %d, got %d", ExitConnLost, rc)
+	}
+}
+
+func TestMain(m *testing.M) {
+	os.Unsetenv("SSH_AUTH_SOCK")
+	os.Exit(m.Run())
+}
+
+// vim: ts=4 sw=4 noet tw=120 softtabstop=4
@@ -0,0 +1,159 @@
+// Copyright 2013 Albert P. Tobey. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gdssh
+
+import (
+	"sync"
+	"time"
+)
+
+type EventType int
+
+const (
+	EventConnecting   EventType = iota // first connect in Start
+	EventConnected                     // Elapsed is how long connecting took
+	EventFailed                        // connecting failed or the connection died, see Err
+	EventReconnecting                  // Attempt is the retry number, Elapsed the delay before it
+	EventClosed                        // by Pool.Close
+	EventTaskStart                     // All, AllSerial or a Rolling batch started a task on the host
+	EventTaskFinish                    // Err is what the task returned, Elapsed how long it ran
+	EventBatch                         // Rolling started a batch, see Batch and Hosts, there's no Conn
+	EventCheckRetry                    // the health check failed with Err, retrying after Elapsed
+	EventCheckFailed                   // the health check didn't pass within Elapsed, Err is the last failure
+)
+
+var eventNames = []string{"connecting", "connected", "failed", "reconnecting", "closed", "task start", "task finish",
+	"batch", "check retry", "check failed"}
+
+func (t EventType) String() string {
+	if int(t) < len(eventNames) {
+		return eventNames[t]
+	}
+	return "unknown"
+}
+
+// Event is something that happened to one connection in a pool.
+type Event struct {
+	Type    EventType
+	Host    string
+	Conn    *Conn
+	Time    time.Time
+	Elapsed time.Duration
+	Attempt int
+	Err     error
+	Batch   int      // for EventBatch, counting from 1
+	Batches int      // for EventBatch
+	Hosts   []string // for EventBatch, the hosts in the batch
+}
+
+// one subscriber's queue, never blocks the pool no matter how slowly the
+// events are read
+type subscriber struct {
+	ch     chan Event
+	queue  []Event
+	wake   chan bool
+	closed bool
+	lock   sync.Mutex
+}
+
+type eventHub struct {
+	subs   []*subscriber
+	closed bool
+	lock   sync.Mutex
+}
+
+// Subscribe returns a channel with every event from now on, it's closed
+// after the pool is closed and the remaining events have been read.
+func (pool *Pool) Subscribe() <-chan Event {
+	sub := &subscriber{
+		ch:   make(chan Event),
+		wake: make(chan bool, 1),
+	}
+
+	pool.events.lock.Lock()
+	if pool.events.closed {
+		sub.closed = true
+	}
+	pool.events.subs = append(pool.events.subs, sub)
+	pool.events.lock.Unlock()
+
+	go sub.deliver()
+	return sub.ch
+}
+
+func (sub *subscriber) deliver() {
+	for {
+		sub.lock.Lock()
+		if len(sub.queue) == 0 {
+			closed := sub.closed
+			sub.lock.Unlock()
+			if closed {
+				close(sub.ch)
+				return
+			}
+			<-sub.wake
+			continue
+		}
+		event := sub.queue[0]
+		sub.queue = sub.queue[1:]
+		sub.lock.Unlock()
+
+		sub.ch <- event
+	}
+}
+
+func (sub *subscriber) push(event Event) {
+	sub.lock.Lock()
+	if !sub.closed {
+		sub.queue = append(sub.queue, event)
+	}
+	sub.lock.Unlock()
+	sub.poke()
+}
+
+func (sub *subscriber) poke() {
+	select {
+	case sub.wake <- true:
+	default:
+	}
+}
+
+func (hub *eventHub) emit(event Event) {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	for _, sub := range hub.subs {
+		sub.push(event)
+	}
+}
+
+// no more events after this, subscribers' channels are closed once drained
+func (hub *eventHub) close() {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	if hub.closed {
+		return
+	}
+	hub.closed = true
+	for _, sub := range hub.subs {
+		sub.lock.Lock()
+		sub.closed = true
+		sub.lock.Unlock()
+		sub.poke()
+	}
+}
+
+func (pool *Pool) emit(t EventType, conn *Conn, elapsed time.Duration, attempt int, err error) {
+	pool.events.emit(Event{
+		Type:    t,
+		Host:    conn.Host,
+		Conn:    conn,
+		Time:    time.Now(),
+		Elapsed: elapsed,
+		Attempt: attempt,
+		Err:     err,
+	})
+}
+
+// vim: ts=4 sw=4 noet tw=120 softtabstop=4
@@ -3,51 +3,115 @@ package gdssh
 // thanks to: http://dave.cheney.net/tag/golang
 
 import (
-	"crypto"
-	"crypto/rsa"
-	"crypto/sha1"
-	"crypto/x509"
-	"encoding/pem"
-	"io"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
 	"io/ioutil"
 	"log"
+	"os"
+	"sync"
 )
 
+// Passphrase is called to get the passphrase for an encrypted private key. The
+// default asks on the terminal, replace it to get passphrases from elsewhere.
+var Passphrase func(keyfile string) ([]byte, error) = promptPassphrase
+
+// private keys are shared by every connection in the process so each file is
+// read, and its passphrase asked for, only once no matter how many hosts there are
 type keyring struct {
-	keys []*rsa.PrivateKey
+	lock    sync.Mutex
+	signers map[string]ssh.Signer
+	errors  map[string]error // don't ask again for a key that already failed
+	skipped map[string]bool  // IdentityFiles that were already reported as unusable
+}
+
+var keys = keyring{
+	signers: make(map[string]ssh.Signer),
+	errors:  make(map[string]error),
+	skipped: make(map[string]bool),
 }
 
-func (k *keyring) Key(i int) (interface{}, error) {
-	if i < 0 || i >= len(k.keys) {
-		return nil, nil
+func (k *keyring) load(file string) (ssh.Signer, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if signer, ok := k.signers[file]; ok {
+		return signer, nil
+	} else if err, ok := k.errors[file]; ok {
+		return nil, err
 	}
-	return k.keys[i].PublicKey, nil
+
+	signer, err := loadKey(file)
+	if err != nil {
+		k.errors[file] = err
+		return nil, err
+	}
+
+	k.signers[file] = signer
+	return signer, nil
 }
 
-func (k *keyring) Sign(i int, rand io.Reader, data []byte) ([]byte, error) {
-	hash := sha1.New()
-	hash.Write(data)
-	return rsa.SignPKCS1v15(rand, k.keys[i], crypto.SHA1, hash.Sum(nil))
+// say why an IdentityFile is skipped, once rather than for every host using it
+func (k *keyring) skip(file string, err error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if !k.skipped[file] {
+		k.skipped[file] = true
+		log.Printf("Skipping IdentityFile: %s", err)
+	}
 }
 
-func (k *keyring) loadPEM(file string) error {
+// load an RSA, ECDSA, ed25519 or DSA key in PKCS#1, PKCS#8, SEC1 or OpenSSH format,
+// asking for the passphrase if it's encrypted
+func loadKey(file string) (ssh.Signer, error) {
 	pemBytes, err := ioutil.ReadFile(file)
 	if err != nil {
-		log.Fatal("Could not load keyfile '", file, "': ", err)
+		return nil, fmt.Errorf("could not load keyfile '%s': %s", file, err)
 	}
 
-	block, comment := pem.Decode(pemBytes)
-	if block == nil {
-		log.Fatal("Could not parse keyfile '", file, "' (", comment, "): ", err)
+	key, err := ssh.ParseRawPrivateKey(pemBytes)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		passphrase, perr := Passphrase(file)
+		if perr != nil {
+			return nil, fmt.Errorf("could not get the passphrase for keyfile '%s': %s", file, perr)
+		}
+		key, err = ssh.ParseRawPrivateKeyWithPassphrase(pemBytes, passphrase)
 	}
+	if err != nil {
+		return nil, fmt.Errorf("could not parse keyfile '%s': %s", file, err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported key in keyfile '%s': %s", file, err)
+	}
+
+	// sign with rsa-sha2-512/256 only, servers are dropping ssh-rsa (SHA-1)
+	if as, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		return ssh.NewSignerWithAlgorithms(as, []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256})
+	}
+
+	return signer, nil
+}
+
+// read a passphrase from the terminal without echoing it
+func promptPassphrase(keyfile string) ([]byte, error) {
+	return readTTY(fmt.Sprintf("Enter passphrase for key '%s': ", keyfile))
+}
 
-	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+// ask on the terminal without echoing, works even when stdin is redirected
+func readTTY(prompt string) ([]byte, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
 	if err != nil {
-		log.Fatal("Could not parse keyfile '", file, "': ", err)
+		return nil, fmt.Errorf("no terminal to ask on: %s", err)
 	}
+	defer tty.Close()
 
-	k.keys = append(k.keys, privateKey)
-	return nil
+	fmt.Fprintf(tty, "%s", prompt)
+	answer, err := term.ReadPassword(int(tty.Fd()))
+	fmt.Fprintf(tty, "\n")
+	return answer, err
 }
 
 // vim: ts=4 sw=4 noet tw=120 softtabstop=4
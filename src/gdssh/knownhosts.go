@@ -0,0 +1,359 @@
+// Copyright 2013 Albert P. Tobey. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gdssh
+
+// OpenSSH known_hosts support, see sshd(8) "SSH_KNOWN_HOSTS FILE FORMAT"
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// host key checking modes, like ssh's StrictHostKeyChecking
+const (
+	HostKeyStrict    = "strict"     // unknown and changed keys are both errors
+	HostKeyAcceptNew = "accept-new" // unknown keys are added to the first file, changed keys are errors
+	HostKeyOff       = "off"        // anything goes
+)
+
+type HostKeyError struct {
+	Host      string // as written in known_hosts, i.e. [host]:port for non-22 ports
+	Changed   bool   // the host is known with a different key, possibly of another type
+	Revoked   bool   // the key is marked @revoked
+	Type      string // the type of key the host offered
+	KnownType string // the type of the conflicting key when Changed
+	File      string // where the conflicting/revoking entry is
+	Line      int
+}
+
+func (e *HostKeyError) Error() string {
+	if e.Revoked {
+		return fmt.Sprintf("host key for %s is revoked (%s:%d)", e.Host, e.File, e.Line)
+	} else if e.Changed && e.KnownType != e.Type {
+		return fmt.Sprintf("host key for %s has CHANGED, it is known with a %s key but offered %s, possible "+
+			"man-in-the-middle attack! Remove the old key from %s:%d if the change is expected.",
+			e.Host, e.KnownType, e.Type, e.File, e.Line)
+	} else if e.Changed {
+		return fmt.Sprintf("host key for %s has CHANGED, possible man-in-the-middle attack! "+
+			"Remove the old key from %s:%d if the change is expected.", e.Host, e.File, e.Line)
+	}
+	return fmt.Sprintf("host key for %s is unknown, add it to %s or use accept-new mode", e.Host, e.File)
+}
+
+type KnownHosts struct {
+	Mode    string
+	files   []string // new keys are written to the first one
+	entries []*knownHost
+	lock    sync.Mutex
+}
+
+// one line of a known_hosts file
+type knownHost struct {
+	marker   string   // @revoked, @cert-authority or empty
+	patterns []string // hostname patterns, possibly negated with !
+	salt     []byte   // for hashed |1|salt|hash entries
+	hash     []byte
+	keyType  string
+	key      []byte // ssh wire format
+	file     string
+	line     int
+}
+
+// LoadKnownHosts reads all of the given known_hosts files, skipping the ones
+// that don't exist and lines that can't be parsed.
+func LoadKnownHosts(mode string, files ...string) (*KnownHosts, error) {
+	switch mode {
+	case HostKeyStrict, HostKeyAcceptNew, HostKeyOff:
+	default:
+		return nil, fmt.Errorf("invalid host key checking mode '%s'", mode)
+	}
+
+	kh := &KnownHosts{Mode: mode, files: files}
+	if mode == HostKeyOff {
+		return kh, nil
+	}
+
+	for _, file := range files {
+		if err := kh.load(file); err != nil {
+			return nil, err
+		}
+	}
+
+	return kh, nil
+}
+
+func (kh *KnownHosts) load(file string) error {
+	fd, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	line_no := 0
+	for scanner.Scan() {
+		line_no++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// ssh ignores lines it can't make sense of, one bad line shouldn't
+		// make every host in the file unknown
+		entry, err := parseKnownHost(line)
+		if err != nil {
+			log.Printf("Skipping %s:%d: %s", file, line_no, err)
+			continue
+		}
+		entry.file = file
+		entry.line = line_no
+		kh.entries = append(kh.entries, entry)
+	}
+
+	return scanner.Err()
+}
+
+func parseKnownHost(line string) (*knownHost, error) {
+	fields := strings.Fields(line)
+	entry := knownHost{}
+
+	if strings.HasPrefix(fields[0], "@") {
+		entry.marker = fields[0]
+		fields = fields[1:]
+	}
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("expected hostnames, key type and key, got '%s'", line)
+	}
+
+	if strings.HasPrefix(fields[0], "|1|") {
+		parts := strings.Split(fields[0][3:], "|")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed hashed hostname '%s'", fields[0])
+		}
+		var err error
+		if entry.salt, err = base64.StdEncoding.DecodeString(parts[0]); err != nil {
+			return nil, fmt.Errorf("malformed hashed hostname salt: %s", err)
+		}
+		if entry.hash, err = base64.StdEncoding.DecodeString(parts[1]); err != nil {
+			return nil, fmt.Errorf("malformed hashed hostname: %s", err)
+		}
+	} else {
+		// host names aren't case sensitive, see knownHostName
+		entry.patterns = strings.Split(strings.ToLower(fields[0]), ",")
+	}
+
+	entry.keyType = fields[1]
+	key, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed %s key: %s", entry.keyType, err)
+	}
+	entry.key = key
+
+	return &entry, nil
+}
+
+// the name a host is recorded and hashed under, lower case like ssh does
+func knownHostName(host string, port int) string {
+	host = strings.ToLower(host)
+	if port == 22 {
+		return host
+	}
+	return fmt.Sprintf("[%s]:%d", host, port)
+}
+
+func (entry *knownHost) matches(name string) bool {
+	if entry.hash != nil {
+		mac := hmac.New(sha1.New, entry.salt)
+		mac.Write([]byte(name))
+		return hmac.Equal(mac.Sum(nil), entry.hash)
+	}
+
+	matched := false
+	for _, pattern := range entry.patterns {
+		if strings.HasPrefix(pattern, "!") {
+			if wildcardMatch(pattern[1:], name) {
+				return false // negations win no matter what
+			}
+		} else if wildcardMatch(pattern, name) {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// ssh_config style pattern matching with * and ?, the [ in [host]:port is literal
+func wildcardMatch(pattern, name string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(name); i >= 0; i-- {
+				if wildcardMatch(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(name) == 0 {
+				return false
+			}
+		default:
+			if len(name) == 0 || pattern[0] != name[0] {
+				return false
+			}
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// returns a callback for one host to use in ssh.ClientConfig. The host is bound
+// here rather than using the hostname passed to the callback since that's the
+// dial address, which isn't always the name in the node list.
+func (kh *KnownHosts) Checker(host string, port int) ssh.HostKeyCallback {
+	if kh.Mode == HostKeyOff {
+		return ssh.InsecureIgnoreHostKey()
+	}
+
+	name := knownHostName(host, port)
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		return kh.check(name, key.Type(), key.Marshal())
+	}
+}
+
+// Algorithms returns the host key algorithms to ask a host for, the types of
+// the keys it's already known with like ssh does. Otherwise the server picks
+// one of its other keys and a known host looks like a new one. Nil for hosts
+// that aren't known, which get the usual defaults.
+func (kh *KnownHosts) Algorithms(host string, port int) (algos []string) {
+	if kh.Mode == HostKeyOff {
+		return nil
+	}
+
+	kh.lock.Lock()
+	defer kh.lock.Unlock()
+
+	name := knownHostName(host, port)
+	seen := make(map[string]bool)
+	for _, entry := range kh.entries {
+		if entry.marker != "" || seen[entry.keyType] || !entry.matches(name) {
+			continue
+		}
+		seen[entry.keyType] = true
+
+		// RSA keys are signed with SHA-2 these days, the key type is still ssh-rsa
+		if entry.keyType == ssh.KeyAlgoRSA {
+			algos = append(algos, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+		algos = append(algos, entry.keyType)
+	}
+	return
+}
+
+func (kh *KnownHosts) check(name string, algorithm string, hostKey []byte) error {
+	kh.lock.Lock()
+	defer kh.lock.Unlock()
+
+	var changed *knownHost
+	known := false
+	for _, entry := range kh.entries {
+		if entry.marker == "@cert-authority" || !entry.matches(name) {
+			continue
+		}
+
+		if bytes.Equal(entry.key, hostKey) {
+			if entry.marker == "@revoked" {
+				return &HostKeyError{Host: name, Revoked: true, Type: algorithm, File: entry.file, Line: entry.line}
+			}
+			known = true
+		} else if entry.marker == "" && (changed == nil || changed.keyType != algorithm && entry.keyType == algorithm) {
+			// any other key means a mismatch, not a new host, but report
+			// the entry of the same type if there is one
+			changed = entry
+		}
+	}
+
+	// a stale entry next to a good one is fine, same as ssh
+	if known {
+		return nil
+	} else if changed != nil {
+		return &HostKeyError{Host: name, Changed: true, Type: algorithm, KnownType: changed.keyType,
+			File: changed.file, Line: changed.line}
+	} else if kh.Mode == HostKeyAcceptNew && len(kh.files) > 0 {
+		return kh.add(name, algorithm, hostKey)
+	}
+
+	file := ""
+	if len(kh.files) > 0 {
+		file = kh.files[0]
+	}
+	return &HostKeyError{Host: name, Type: algorithm, File: file}
+}
+
+// append a new key to the first file, hashed if the file already has hashed
+// entries so it doesn't give away names that ssh hid. The caller must hold the lock.
+func (kh *KnownHosts) add(name string, algorithm string, hostKey []byte) error {
+	file := kh.files[0]
+	os.MkdirAll(path.Dir(file), 0700)
+
+	entry := &knownHost{
+		keyType: algorithm,
+		key:     hostKey,
+		file:    file,
+	}
+	host := name
+	if kh.hashed(file) {
+		entry.salt = make([]byte, sha1.Size)
+		if _, err := rand.Read(entry.salt); err != nil {
+			return fmt.Errorf("could not add host key for %s to %s: %s", name, file, err)
+		}
+		mac := hmac.New(sha1.New, entry.salt)
+		mac.Write([]byte(name))
+		entry.hash = mac.Sum(nil)
+		host = fmt.Sprintf("|1|%s|%s", base64.StdEncoding.EncodeToString(entry.salt),
+			base64.StdEncoding.EncodeToString(entry.hash))
+	} else {
+		entry.patterns = []string{name}
+	}
+
+	fd, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("could not add host key for %s to %s: %s", name, file, err)
+	}
+	defer fd.Close()
+
+	encoded := base64.StdEncoding.EncodeToString(hostKey)
+	if _, err = fmt.Fprintf(fd, "%s %s %s\n", host, algorithm, encoded); err != nil {
+		return fmt.Errorf("could not add host key for %s to %s: %s", name, file, err)
+	}
+
+	kh.entries = append(kh.entries, entry)
+	return nil
+}
+
+// whether file has any hashed entries, the caller must hold the lock
+func (kh *KnownHosts) hashed(file string) bool {
+	for _, entry := range kh.entries {
+		if entry.file == file && entry.hash != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// vim: ts=4 sw=4 noet tw=120 softtabstop=4
@@ -0,0 +1,335 @@
+// Copyright 2013 Albert P. Tobey. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gdssh
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+)
+
+func newEd25519Key(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newECDSAKey(t *testing.T) ssh.PublicKey {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// "type base64" as it appears in known_hosts
+func keyText(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+// |1|salt|hash for name, like ssh-keygen -H
+func hashedName(name string) string {
+	salt := make([]byte, sha1.Size)
+	rand.Read(salt)
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(name))
+	return fmt.Sprintf("|1|%s|%s", base64.StdEncoding.EncodeToString(salt),
+		base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+// write a known_hosts file in a temp dir and load it
+func loadTestKnownHosts(t *testing.T, mode string, lines ...string) (*KnownHosts, string) {
+	file := path.Join(t.TempDir(), "known_hosts")
+	if err := ioutil.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	kh, err := LoadKnownHosts(mode, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kh, file
+}
+
+func TestParseKnownHost(t *testing.T) {
+	key := keyText(newEd25519Key(t))
+	tests := []struct {
+		line     string
+		ok       bool
+		marker   string
+		patterns []string
+		hashed   bool
+	}{
+		{"web1 " + key, true, "", []string{"web1"}, false},
+		{"web1,10.0.0.1,[web1]:2222 " + key, true, "", []string{"web1", "10.0.0.1", "[web1]:2222"}, false},
+		{"Web1.Example.COM " + key, true, "", []string{"web1.example.com"}, false},
+		{"*.example.com,!bad.example.com " + key + " comment here", true, "", []string{"*.example.com", "!bad.example.com"}, false},
+		{"@revoked * " + key, true, "@revoked", []string{"*"}, false},
+		{"@cert-authority *.example.com " + key, true, "@cert-authority", []string{"*.example.com"}, false},
+		{hashedName("web1") + " " + key, true, "", nil, true},
+		{"web1", false, "", nil, false},
+		{"web1 ssh-ed25519", false, "", nil, false},
+		{"@revoked web1 ssh-ed25519", false, "", nil, false},
+		{"web1 ssh-ed25519 not-base64!", false, "", nil, false},
+		{"|1|onlysalt " + key, false, "", nil, false},
+		{"|1|!!!|!!! " + key, false, "", nil, false},
+	}
+
+	for _, test := range tests {
+		entry, err := parseKnownHost(test.line)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.line)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%q: %s", test.line, err)
+			continue
+		}
+
+		if entry.marker != test.marker {
+			t.Errorf("%q: expected marker %q, got %q", test.line, test.marker, entry.marker)
+		}
+		if strings.Join(entry.patterns, " ") != strings.Join(test.patterns, " ") {
+			t.Errorf("%q: expected patterns %q, got %q", test.line, test.patterns, entry.patterns)
+		}
+		if (entry.hash != nil) != test.hashed {
+			t.Errorf("%q: expected hashed %t", test.line, test.hashed)
+		}
+		if entry.keyType != ssh.KeyAlgoED25519 {
+			t.Errorf("%q: expected key type %s, got %s", test.line, ssh.KeyAlgoED25519, entry.keyType)
+		}
+	}
+}
+
+func TestKnownHostMatches(t *testing.T) {
+	key := keyText(newEd25519Key(t))
+	tests := []struct {
+		hosts string
+		host  string
+		port  int
+		want  bool
+	}{
+		{"web1", "web1", 22, true},
+		{"web1", "web2", 22, false},
+		{"web1", "web1", 2222, false},
+		{"[web1]:2222", "web1", 2222, true},
+		{"[web1]:2222", "web1", 22, false},
+		{"web1,web2", "web2", 22, true},
+		{"WEB1", "web1", 22, true},
+		{"web1", "Web1", 22, true},
+		{"*.example.com", "db.example.com", 22, true},
+		{"*.example.com", "example.com", 22, false},
+		{"web?", "web1", 22, true},
+		{"web?", "web10", 22, false},
+		{"*.example.com,!db.example.com", "db.example.com", 22, false},
+		{"!db.example.com,*.example.com", "db.example.com", 22, false},
+		{"*.example.com,!db.example.com", "web.example.com", 22, true},
+		{"!db.example.com", "web.example.com", 22, false},
+		{"[*.example.com]:*", "db.example.com", 2222, true},
+		{hashedName("web1"), "web1", 22, true},
+		{hashedName("web1"), "WEB1", 22, true},
+		{hashedName("web1"), "web2", 22, false},
+		{hashedName("[web1]:2222"), "web1", 2222, true},
+		{hashedName("[web1]:2222"), "web1", 22, false},
+	}
+
+	for _, test := range tests {
+		entry, err := parseKnownHost(test.hosts + " " + key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := entry.matches(knownHostName(test.host, test.port)); got != test.want {
+			t.Errorf("%s against %s port %d: expected %t, got %t", test.hosts, test.host, test.port, test.want, got)
+		}
+	}
+}
+
+func TestKnownHostsCheck(t *testing.T) {
+	key := newEd25519Key(t)
+	other := newEd25519Key(t)
+	ecdsaKey := newECDSAKey(t)
+
+	const (
+		ok       = "ok"
+		unknown  = "unknown"
+		changed  = "changed"
+		revoked  = "revoked"
+		otherTyp = "changed type"
+	)
+	tests := []struct {
+		name    string
+		lines   []string
+		offered ssh.PublicKey
+		want    string
+	}{
+		{"known", []string{"web1 " + keyText(key)}, key, ok},
+		{"known hashed", []string{hashedName("web1") + " " + keyText(key)}, key, ok},
+		{"known by wildcard", []string{"web* " + keyText(key)}, key, ok},
+		{"unknown", []string{"web2 " + keyText(key)}, key, unknown},
+		{"empty file", nil, key, unknown},
+		{"changed", []string{"web1 " + keyText(other)}, key, changed},
+		{"changed hashed", []string{hashedName("web1") + " " + keyText(other)}, key, changed},
+		{"other type only", []string{"web1 " + keyText(ecdsaKey)}, key, otherTyp},
+		{"same type reported", []string{"web1 " + keyText(ecdsaKey), "web1 " + keyText(other)}, key, changed},
+		{"stale entry next to a good one", []string{"web1 " + keyText(other), "web1 " + keyText(key)}, key, ok},
+		{"negated", []string{"*,!web1 " + keyText(key)}, key, unknown},
+		{"revoked", []string{"web1 " + keyText(key), "@revoked * " + keyText(key)}, key, revoked},
+		{"revoked other key", []string{"web1 " + keyText(key), "@revoked * " + keyText(other)}, key, ok},
+		{"cert authority ignored", []string{"@cert-authority * " + keyText(key)}, key, unknown},
+		{"bad line skipped", []string{"web1 ssh-ed25519 not-base64!", "web1 " + keyText(key)}, key, ok},
+	}
+
+	for _, test := range tests {
+		kh, _ := loadTestKnownHosts(t, HostKeyStrict, test.lines...)
+		err := kh.Checker("web1", 22)("web1:22", nil, test.offered)
+
+		got := ok
+		var hke *HostKeyError
+		if errors.As(err, &hke) {
+			switch {
+			case hke.Revoked:
+				got = revoked
+			case hke.Changed && hke.KnownType != hke.Type:
+				got = otherTyp
+			case hke.Changed:
+				got = changed
+			default:
+				got = unknown
+			}
+		} else if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: expected %s, got %s (%v)", test.name, test.want, got, err)
+		}
+	}
+}
+
+func TestKnownHostsAlgorithms(t *testing.T) {
+	key := newEd25519Key(t)
+	ecdsaKey := newECDSAKey(t)
+	kh, _ := loadTestKnownHosts(t, HostKeyStrict,
+		"web1 "+keyText(key),
+		"web1 "+keyText(ecdsaKey),
+		"web1 "+keyText(newEd25519Key(t)),
+		"@revoked web1 "+keyText(newECDSAKey(t)))
+
+	algos := kh.Algorithms("WEB1", 22)
+	if strings.Join(algos, " ") != ssh.KeyAlgoED25519+" "+ecdsaKey.Type() {
+		t.Errorf("expected the two known types, got %q", algos)
+	}
+	if algos := kh.Algorithms("web2", 22); algos != nil {
+		t.Errorf("expected nothing for an unknown host, got %q", algos)
+	}
+}
+
+func TestKnownHostsAcceptNew(t *testing.T) {
+	for _, hashed := range []bool{false, true} {
+		existing := "web2 " + keyText(newEd25519Key(t))
+		if hashed {
+			existing = hashedName("web2") + " " + keyText(newEd25519Key(t))
+		}
+		kh, file := loadTestKnownHosts(t, HostKeyAcceptNew, existing)
+
+		key := newEd25519Key(t)
+		if err := kh.Checker("Web1", 2222)("web1:2222", nil, key); err != nil {
+			t.Fatalf("hashed %t: accept-new of an unknown host failed: %s", hashed, err)
+		}
+		// a different key for the host that was just added is still a change
+		if err := kh.Checker("web1", 2222)("web1:2222", nil, newEd25519Key(t)); err == nil {
+			t.Errorf("hashed %t: accept-new took a second key for a host it just added", hashed)
+		}
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("hashed %t: expected 2 lines, got %q", hashed, lines)
+		}
+		added := lines[1]
+		if hashed && (!strings.HasPrefix(added, "|1|") || strings.Contains(added, "web1")) {
+			t.Errorf("expected a hashed entry, got %q", added)
+		} else if !hashed && added != "[web1]:2222 "+keyText(key) {
+			t.Errorf("expected a plain entry, got %q", added)
+		}
+
+		// and it's known from the file next time
+		strict, err := LoadKnownHosts(HostKeyStrict, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := strict.Checker("web1", 2222)("web1:2222", nil, key); err != nil {
+			t.Errorf("hashed %t: added key isn't known after a reload: %s", hashed, err)
+		}
+	}
+}
+
+func TestKnownHostsConnect(t *testing.T) {
+	srv := newTestServer(t, false)
+	file := path.Join(t.TempDir(), "known_hosts")
+
+	connect := func(mode string) error {
+		kh, err := LoadKnownHosts(mode, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := srv.conn("")
+		conn.HostKeys = kh.Checker(conn.HostName, conn.Port)
+		conn.HostKeyAlgos = kh.Algorithms(conn.HostName, conn.Port)
+		err = conn.Connect()
+		conn.Close()
+		return err
+	}
+
+	if err := connect(HostKeyStrict); !errors.Is(err, ErrHostKey) {
+		t.Fatalf("expected ErrHostKey for an unknown host in strict mode, got %v", err)
+	}
+	if err := connect(HostKeyAcceptNew); err != nil {
+		t.Fatalf("accept-new failed: %s", err)
+	}
+	conn := srv.conn("")
+	host := knownHostName(conn.HostName, conn.Port)
+	if data, _ := ioutil.ReadFile(file); string(data) != host+" "+keyText(srv.hostKey)+"\n" {
+		t.Fatalf("expected accept-new to add the server's key, got %q", data)
+	}
+	if err := connect(HostKeyStrict); err != nil {
+		t.Fatalf("strict failed after accept-new added the key: %s", err)
+	}
+
+	// same host and port with another key, like a reinstalled server
+	line := host + " " + keyText(newEd25519Key(t)) + "\n"
+	if err := ioutil.WriteFile(file, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := connect(HostKeyAcceptNew); !errors.Is(err, ErrHostKey) {
+		t.Fatalf("expected ErrHostKey for a changed key in accept-new mode, got %v", err)
+	}
+}
+
+// vim: ts=4 sw=4 noet tw=120 softtabstop=4
@@ -0,0 +1,115 @@
+// Copyright 2013 Albert P. Tobey. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gdssh
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// Password is opt-in password and keyboard-interactive authentication for
+// hosts that don't take keys. One is meant to be shared by a whole pool so the
+// password is only asked for or read once.
+type Password struct {
+	source   func() ([]byte, error)
+	once     sync.Once
+	password string
+	err      error
+}
+
+func NewPassword(source func() ([]byte, error)) *Password {
+	return &Password{source: source}
+}
+
+// PromptPassword asks for the password on the terminal without echoing it.
+func PromptPassword() *Password {
+	return PromptFor("Password (used for all hosts): ")
+}
+
+// PromptFor is PromptPassword with a different prompt, e.g. for sudo.
+func PromptFor(prompt string) *Password {
+	return NewPassword(func() ([]byte, error) {
+		return readTTY(prompt)
+	})
+}
+
+// EnvPassword takes the password from an environment variable, which has to be set.
+func EnvPassword(name string) (*Password, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("$%s is not set", name)
+	}
+	return NewPassword(func() ([]byte, error) {
+		return []byte(value), nil
+	}), nil
+}
+
+// FilePassword reads the password from the first line of a file that only its
+// owner can read, same rule ssh has for private keys.
+func FilePassword(file string) (*Password, error) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("permissions %04o for '%s' are too open, it must not be accessible by others",
+			fi.Mode().Perm(), file)
+	}
+
+	return NewPassword(func() ([]byte, error) {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			data = data[:i]
+		}
+		return bytes.TrimRight(data, "\r"), nil
+	}), nil
+}
+
+// Get returns the password, asking for it the first time. Call it before
+// connecting so the prompt doesn't eat into connect timeouts.
+func (pw *Password) Get() (string, error) {
+	pw.once.Do(func() {
+		password, err := pw.source()
+		if err != nil {
+			pw.err = fmt.Errorf("could not get the password: %s", err)
+			return
+		}
+		pw.password = string(password)
+	})
+	return pw.password, pw.err
+}
+
+// answer every keyboard-interactive question that doesn't echo with the
+// password, usually there's just one "Password:"
+func (pw *Password) challenge(user, instruction string, questions []string, echos []bool) ([]string, error) {
+	answers := make([]string, len(questions))
+	for i := range questions {
+		if echos[i] {
+			continue
+		}
+		password, err := pw.Get()
+		if err != nil {
+			return nil, err
+		}
+		answers[i] = password
+	}
+	return answers, nil
+}
+
+func (pw *Password) authMethods() []ssh.AuthMethod {
+	return []ssh.AuthMethod{
+		ssh.PasswordCallback(pw.Get),
+		ssh.KeyboardInteractive(pw.challenge),
+	}
+}
+
+// vim: ts=4 sw=4 noet tw=120 softtabstop=4
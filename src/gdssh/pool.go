@@ -5,31 +5,94 @@
 package gdssh
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"golang.org/x/crypto/ssh"
+	"math/rand"
 	"sync"
 	"time"
 )
 
+// returned for tasks skipped because the pool was cancelled
+var ErrCancelled = errors.New("cancelled")
+
+// returned by Add for a connection that's in the pool already
+var ErrInPool = errors.New("already in the pool")
+
+// returned by Add for a connection that was removed from a pool or closed
+// with it, it can't be connected again and has to be replaced with a new Conn
+var ErrStopped = errors.New("connection was removed or closed for good")
+
+// reconnect backoff doubles up to this many RetryIntervals
+const maxBackoff = 32
+
 type Task interface {
 	Run(conn *Conn) error
 }
 
+// Tasks can also implement ResultTask to attach output to their result or
+// report partial success. RunResult is called instead of Run, with Host and
+// Start already filled in, and what it returns becomes the result's Err. ctx
+// has the deadline of the All/Run call, use Conn.CommandContext to honor it.
+type ResultTask interface {
+	RunResult(ctx context.Context, conn *Conn, res *Result) error
+}
+
+// Result is what happened when a task was run on one host.
+type Result struct {
+	Host    string
+	Err     error     // from the task, or why it wasn't run (e.g. *UnreachableError, ErrTimeout)
+	Start   time.Time // zero if the task never started
+	End     time.Time
+	Output  []byte      // whatever a ResultTask attached, e.g. the command's output
+	Value   interface{} // anything else a ResultTask wants to hand back, e.g. an exit status
+	Partial bool        // the task got some of its work done before it failed, Err says what didn't
+}
+
+func (r *Result) Duration() time.Duration {
+	if r.Start.IsZero() {
+		return 0
+	}
+	return r.End.Sub(r.Start)
+}
+
 type Pool struct {
-	conns         []*Conn
-	lock          sync.Mutex
-	messages      chan string // messages related to connection management
-	errors        chan error  // connection errors
-	done          bool
-	MaxRetries    int // maximum retries per connection
-	RetryInterval int // seconds
-	Retries       int // running total for the pool
+	conns          []*Conn
+	lock           sync.Mutex
+	events         eventHub       // see Subscribe
+	started        bool           // set by Start, conns added after that are connected right away
+	done           bool           // set by Close, guarded by lock
+	next           int            // for Pick
+	monitors       sync.WaitGroup // Start's goroutines, each ends up running monitor
+	connects       chan bool      // Fanout semaphore for connecting, shared by Start and Add
+	cancel         chan bool      // closed by Cancel, tasks that haven't started yet are skipped
+	cancelOnce     sync.Once
+	Fanout         int           // maximum concurrent connects/tasks, 0 for unlimited
+	KnownHosts     *KnownHosts   // host key checking for connections without their own HostKeys
+	Password       *Password     // for connections without their own, nil for keys only
+	Agent          *Agent        // shared by connections without their own, SystemAgent() by default
+	ConnectTimeout time.Duration // default Conn.ConnectTimeout, 0 for no limit
+	CommandTimeout time.Duration // default Conn.CommandTimeout, 0 for no limit
+	Timeout        time.Duration // for a whole All/AllSerial call or Rolling batch, 0 for no limit
+	Keepalive      time.Duration // interval between keepalive requests, 0 to only notice closed connections
+	KeepaliveMax   int           // unanswered keepalives before a connection is considered dead
+	ReconnectWait  time.Duration // how long tasks wait for a dropped connection to come back
+	ConnectWait    time.Duration // how long hosts that failed to connect are retried and waited for, 0 to skip them
+	MaxRetries     int           // maximum reconnects in a row per connection
+	RetryInterval  int           // seconds
+	Retries        int           // running total for the pool
 }
 
 func NewPool() *Pool {
 	return &Pool{
-		messages:      make(chan string),
-		errors:        make(chan error),
 		done:          false,
+		cancel:        make(chan bool),
+		Agent:         SystemAgent(),
+		Fanout:        0,
+		Keepalive:     15 * time.Second,
+		KeepaliveMax:  3,
+		ReconnectWait: 30 * time.Second,
 		MaxRetries:    100,
 		RetryInterval: 2,
 		Retries:       0,
@@ -44,106 +107,625 @@ func (pool *Pool) Configure(list map[string]int, user string, key string) {
 	}
 }
 
-func (pool *Pool) Add(conn *Conn) {
+// Add a connection to the pool. Once the pool is started it's connected and
+// monitored right away, still at most Fanout connects at a time, after Close
+// it's ignored. A connection can only be in the pool once, and one that was
+// removed can't be added back, use NewConn for the same host again.
+func (pool *Pool) Add(conn *Conn) error {
 	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	if pool.done {
+		return nil
+	}
+
+	for _, c := range pool.conns {
+		if c == conn {
+			return ErrInPool
+		}
+	}
+	if conn.stopped() {
+		return ErrStopped
+	}
+
 	pool.conns = append(pool.conns, conn)
+	if pool.started {
+		pool.setDefaults(conn)
+		pool.monitors.Add(1)
+		go pool.connect(conn, pool.connects, nil)
+	}
+	return nil
+}
+
+// Remove takes a connection out of the pool and closes it, tasks still running
+// on it fail. Returns false if it wasn't in the pool. Jump hosts are shared, so
+// they're left alone until Close.
+func (pool *Pool) Remove(conn *Conn) bool {
+	pool.lock.Lock()
+	found := false
+	conns := make([]*Conn, 0, len(pool.conns))
+	for _, c := range pool.conns {
+		if c == conn {
+			found = true
+		} else {
+			conns = append(conns, c)
+		}
+	}
+	pool.conns = conns // a new slice, callers of Conns() may still be using the old one
+	if found {
+		conn.stop() // before unlocking so Add can't take it back in the meantime
+	}
 	pool.lock.Unlock()
+
+	if !found {
+		return false
+	}
+	conn.Close()
+	pool.emit(EventClosed, conn, 0, 0, nil)
+	return true
+}
+
+// Conns returns the connections in the pool in the order they were added.
+func (pool *Pool) Conns() []*Conn {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	return append([]*Conn(nil), pool.conns...)
 }
 
-func (pool *Pool) msg(format string, a ...interface{}) {
-	// TODO: remove this print
-	fmt.Printf(format, a)
-	fmt.Print("\n")
-	pool.messages <- fmt.Sprintf(format, a)
+// Healthy returns the connections that are up right now.
+func (pool *Pool) Healthy() (conns []*Conn) {
+	for _, conn := range pool.Conns() {
+		if conn.Alive() {
+			conns = append(conns, conn)
+		}
+	}
+	return
 }
 
-func (pool *Pool) err(e error) {
-	// TODO: remove this print
-	fmt.Printf("ERROR: %s\n", e)
-	pool.errors <- e
+// Pick returns a connection that's up, taking turns between them, for tasks
+// that only need to run somewhere. ErrNotConnected if none of them are.
+func (pool *Pool) Pick() (*Conn, error) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	for range pool.conns {
+		pool.next = (pool.next + 1) % len(pool.conns)
+		if conn := pool.conns[pool.next]; conn.Alive() {
+			return conn, nil
+		}
+	}
+	return nil, ErrNotConnected
 }
 
-// expected to be run as a goroutine per connection
-func monitor(pool *Pool, conn *Conn) {
-	secs := pool.RetryInterval // int seconds
-	ivl := time.Duration(secs) * time.Second
+// returns a channel to use as a counting semaphore for Fanout, nil when unlimited
+// so acquire/release are no-ops
+func (pool *Pool) semaphore() chan bool {
+	if pool.Fanout > 0 {
+		return make(chan bool, pool.Fanout)
+	}
+	return nil
+}
+
+func acquire(sem chan bool) {
+	if sem != nil {
+		sem <- true
+	}
+}
 
-	time.Sleep(ivl) // wait at least one interval before looping
+func release(sem chan bool) {
+	if sem != nil {
+		<-sem
+	}
+}
 
+// expected to be run as a goroutine per connection once it has connected,
+// keeps the connection up until conn.done is closed or it gives up, which
+// stops the connection for good
+func monitor(pool *Pool, conn *Conn) {
+	ivl := pool.Keepalive
+	if ivl <= 0 {
+		ivl = time.Duration(pool.RetryInterval) * time.Second
+	}
 	ticker := time.NewTicker(ivl)
+	defer ticker.Stop()
 
-	// TODO: limit retries & fail
+	// a reconnect can finish after Close or Remove already closed the connection
+	defer func() {
+		if conn.stopped() {
+			conn.Close()
+		}
+	}()
+
+	missed := 0
 	for {
-		select {
-		case t, _ := <-ticker.C:
-			if !conn.Alive() {
-				pool.lock.Lock()
-				if next := conn.Started.Add(ivl); next.After(t) {
-					err := conn.Reconnect()
-					if err != nil {
-						pool.err(err)
-						pool.msg("Reconnect failed, next retry in %d seconds: %s", secs, err)
-					}
-				} else {
-					pool.msg("Retrying connection to %s in ~%d seconds.", conn.address, secs)
-				}
-				pool.lock.Unlock()
+		if !conn.Alive() {
+			if !pool.reconnect(conn) {
+				conn.stop()
+				return
 			}
+			missed = 0
+		}
+
+		select {
+		case <-ticker.C:
+		case <-conn.done:
+			return
+		}
+
+		// the client notices closed connections on its own, keepalives catch
+		// the ones that just stop answering
+		if pool.Keepalive <= 0 || !conn.Alive() {
+			continue
+		}
+		err := conn.Ping(pool.Keepalive)
+		if err == nil {
+			missed = 0
+			continue
+		}
+		missed++
+		if err != ErrTimeout || missed >= pool.KeepaliveMax {
+			conn.Close()
+			pool.emit(EventFailed, conn, 0, 0, conn.hostError(ErrConnLost, err))
+		}
+	}
+}
+
+// reconnect with exponential backoff starting at RetryInterval, jittered and
+// at most Fanout connects at a time, giving up after MaxRetries attempts in a
+// row or right away on a bad key or a rejected host key or login. Returns
+// whether it's connected.
+func (pool *Pool) reconnect(conn *Conn) bool {
+	ivl := time.Duration(pool.RetryInterval) * time.Second
+	delay := ivl
+	for attempt := 1; attempt <= pool.MaxRetries; attempt++ {
+		wait := jitter(delay)
+		pool.emit(EventReconnecting, conn, wait, attempt, nil)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
 		case <-conn.done:
-			break
+			timer.Stop()
+			return false
+		}
+
+		pool.lock.Lock()
+		pool.Retries++
+		pool.lock.Unlock()
+		conn.Retries++
+
+		// all of the hosts drop at once when the network hiccups, they get
+		// Fanout at a time to come back like the first connect
+		acquire(pool.connects)
+		start := time.Now()
+		err := conn.Reconnect()
+		release(pool.connects)
+		if err == nil {
+			pool.emit(EventConnected, conn, time.Since(start), attempt, nil)
+			return true
+		}
+		pool.emit(EventFailed, conn, time.Since(start), attempt, err)
+		if permanent(err) {
+			return false
+		}
+
+		if delay < maxBackoff*ivl {
+			delay *= 2
 		}
 	}
+
+	err := conn.hostError(ErrConnLost, fmt.Errorf("giving up after %d retries", pool.MaxRetries))
+	pool.emit(EventFailed, conn, 0, pool.MaxRetries, err)
+	return false
+}
+
+// somewhere between half and one and a half times d, so connections that
+// dropped together don't all retry at the same moment
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
 }
 
+// pass the pool's connect settings on to a connection and its jump hosts
+// unless they have their own. Jump hosts are shared so this has to be done
+// before connecting starts.
+func (pool *Pool) setDefaults(conn *Conn) {
+	for c := conn; c != nil; c = c.Jump {
+		if c.ConnectTimeout == 0 {
+			c.ConnectTimeout = pool.ConnectTimeout
+		}
+		if c.HostKeys == nil && pool.KnownHosts != nil {
+			c.HostKeys = pool.KnownHosts.Checker(c.HostName, c.Port)
+			c.HostKeyAlgos = pool.KnownHosts.Algorithms(c.HostName, c.Port)
+		}
+		if c.Password == nil {
+			c.Password = pool.Password
+		}
+		if c.Agent == nil {
+			c.Agent = pool.Agent
+		}
+	}
+
+	if conn.CommandTimeout == 0 {
+		conn.CommandTimeout = pool.CommandTimeout
+	}
+}
+
+// Start connects everything in the pool and returns when each connection has
+// either connected or failed to. The pool keeps them up until Close.
 func (pool *Pool) Start() {
+	// Close waits on monitors, so it can't be added to after the pool is closed
+	pool.lock.Lock()
+	if pool.done || pool.started {
+		pool.lock.Unlock()
+		return
+	}
+	pool.started = true
+	pool.connects = pool.semaphore()
+	conns := pool.conns
+	for _, conn := range conns {
+		pool.setDefaults(conn)
+	}
+	pool.monitors.Add(len(conns))
+	pool.lock.Unlock()
+
 	wg := sync.WaitGroup{}
-	for _, conn := range pool.conns {
-		var cp = conn // local pointer copy for the goroutine to close over
-		wg.Add(1)
-		go func() {
-			err := cp.Connect()
+	wg.Add(len(conns))
+	for _, conn := range conns {
+		go pool.connect(conn, pool.connects, &wg)
+	}
+	wg.Wait()
+}
 
-			if err != nil {
-				pool.err(err)
-				pool.msg("Connection failed: %s", err)
-			}
+// first connect, then monitor keeps it up. Counted in pool.monitors, wg is
+// told when the first connect is over regardless of success/failure.
+func (pool *Pool) connect(conn *Conn, sem chan bool, wg *sync.WaitGroup) {
+	defer pool.monitors.Done()
 
-			// regardless of success/failure
-			wg.Done()
+	acquire(sem)
+	pool.emit(EventConnecting, conn, 0, 0, nil)
+	start := time.Now()
+	err := conn.Connect()
+	release(sem)
 
-			// monitor keeps running
-			monitor(pool, cp)
-		}()
+	if err != nil {
+		pool.emit(EventFailed, conn, time.Since(start), 0, err)
+	} else {
+		pool.emit(EventConnected, conn, time.Since(start), 0, nil)
 	}
-	wg.Wait()
-	fmt.Printf("Connection pool is up!\n")
+
+	if wg != nil {
+		wg.Done()
+	}
+
+	// hosts that are down or misconfigured aren't retried, that only fills
+	// the screen with errors, unless tasks are told to wait for them
+	if err != nil && !pool.retryConnect(conn, err) {
+		conn.stop()
+		return
+	}
+
+	monitor(pool, conn)
+}
+
+// quietly retry a failed first connect for up to ConnectWait, returns whether it connected
+func (pool *Pool) retryConnect(conn *Conn, err error) bool {
+	ivl := time.Duration(pool.RetryInterval) * time.Second
+	deadline := time.Now().Add(pool.ConnectWait)
+	for !permanent(err) && time.Now().Add(ivl).Before(deadline) {
+		timer := time.NewTimer(ivl)
+		select {
+		case <-timer.C:
+		case <-conn.done:
+			timer.Stop()
+			return false
+		}
+
+		acquire(pool.connects)
+		start := time.Now()
+		err = conn.Connect()
+		release(pool.connects)
+		if err == nil {
+			pool.emit(EventConnected, conn, time.Since(start), 0, nil)
+			return true
+		}
+	}
+	return false
 }
 
+// Close stops the monitors, waits for them to exit and closes all of the
+// connections. Only the first call does anything.
 func (pool *Pool) Close() {
-	for _, conn := range pool.conns {
+	pool.lock.Lock()
+	if pool.done {
+		pool.lock.Unlock()
+		return
+	}
+	pool.done = true
+	conns := pool.conns
+	pool.lock.Unlock()
+
+	// closing the connections wakes up monitors waiting on a keepalive, done
+	// stops the ones waiting to reconnect
+	for _, conn := range conns {
+		conn.stop()
 		conn.Close()
 	}
+	pool.monitors.Wait()
+
+	jumps := make(map[*Conn]bool)
+	for _, conn := range conns {
+		conn.Close() // again, a monitor might have been in the middle of reconnecting
+		for j := conn.Jump; j != nil; j = j.Jump {
+			jumps[j] = true
+		}
+	}
+
+	// jump hosts last, nodes are tunneled through them
+	for jump := range jumps {
+		if jump.Alive() {
+			jump.Close()
+		}
+	}
+
+	for _, conn := range conns {
+		pool.emit(EventClosed, conn, 0, 0, nil)
+	}
+	pool.events.close()
+}
+
+// Cancel stops the pool from starting any more tasks in All, AllSerial or Rolling.
+// Tasks that are already running are left alone, use Signal or Kill for those.
+func (pool *Pool) Cancel() {
+	pool.cancelOnce.Do(func() {
+		close(pool.cancel)
+	})
+}
+
+func (pool *Pool) Cancelled() bool {
+	select {
+	case <-pool.cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// send a signal to every running command in the pool, returns the hosts that had any
+func (pool *Pool) Signal(sig ssh.Signal) (hosts []string) {
+	for _, conn := range pool.Conns() {
+		if conn.Signal(sig) > 0 {
+			hosts = append(hosts, conn.Host)
+		}
+	}
+	return
+}
+
+// kill every running command in the pool, returns the hosts that had any
+func (pool *Pool) Kill() (hosts []string) {
+	for _, conn := range pool.Conns() {
+		if conn.Kill() > 0 {
+			hosts = append(hosts, conn.Host)
+		}
+	}
+	return
+}
+
+// run the task on every connection in parallel, at most Fanout at a time.
+// Returns every host's result, hosts that couldn't be connected to are
+// skipped with an *UnreachableError.
+func (pool *Pool) All(task Task) map[string]Result {
+	return byHost(pool.all(pool.Conns(), task))
+}
+
+// Run runs the task on every connection in the pool, at most Fanout at a time,
+// and returns each host's result. Once ctx is done no more tasks are started
+// and Run returns right away, tasks that are still running get ErrTimeout or
+// ErrCancelled as their result. They aren't stopped, except commands a
+// ResultTask made with CommandContext stop at ctx's deadline. Unlike All it
+// doesn't use the pool's Timeout. It can be called concurrently, with itself
+// and with All etc.
+func (pool *Pool) Run(ctx context.Context, task Task) map[string]Result {
+	return byHost(pool.parallel(ctx, pool.Conns(), task, 0))
+}
+
+// Unreachable returns the connections that have never been connected.
+func (pool *Pool) Unreachable() (conns []*Conn) {
+	for _, conn := range pool.Conns() {
+		if conn.started().IsZero() {
+			conns = append(conns, conn)
+		}
+	}
+	return
 }
 
-func (pool *Pool) All(task Task) {
+// All and Rolling batches: with a pool Timeout, commands made with
+// CommandContext are stopped at the deadline and given time to be killed
+// before the tasks are given up on
+func (pool *Pool) all(conns []*Conn, task Task) map[*Conn]*Result {
+	ctx := context.Background()
+	deadline := pool.deadline()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	return pool.parallel(ctx, conns, task, 2*KillGrace)
+}
+
+// run the task on each of conns in parallel, at most Fanout at a time. Tasks
+// that haven't started when ctx is done are skipped, tasks that are still
+// running grace after that are given up on. Both get ErrTimeout or ErrCancelled.
+func (pool *Pool) parallel(ctx context.Context, conns []*Conn, task Task, grace time.Duration) map[*Conn]*Result {
+	finished := make(map[*Conn]*Result)
+	lock := sync.Mutex{}
 	wg := sync.WaitGroup{}
-	for _, conn := range pool.conns {
+	sem := pool.semaphore()
+
+	for _, conn := range conns {
 		wg.Add(1)
 		go func(c *Conn) {
-			task.Run(c)
+			acquire(sem)
+			res := pool.run(ctx, task, c)
+			release(sem)
+
+			lock.Lock()
+			finished[c] = res
+			lock.Unlock()
 			wg.Done()
 		}(conn)
 	}
-	fmt.Printf("Waiting for all tasks to run ...\n")
-	wg.Wait()
-	return
+
+	all := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(all)
+	}()
+
+	select {
+	case <-all:
+	case <-ctx.Done():
+		timer := time.NewTimer(grace)
+		select {
+		case <-all:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+
+	// copy since stuck tasks may still write to finished
+	lock.Lock()
+	defer lock.Unlock()
+	results := make(map[*Conn]*Result)
+	for _, conn := range conns {
+		if res, ok := finished[conn]; ok {
+			results[conn] = res
+		} else {
+			results[conn] = &Result{Host: conn.Host, Err: ctxError(ctx)}
+		}
+	}
+	return results
 }
 
-func (pool *Pool) AllSerial(task Task) {
-	for _, conn := range pool.conns {
-		task.Run(conn)
+func byHost(results map[*Conn]*Result) map[string]Result {
+	hosts := make(map[string]Result)
+	for conn, res := range results {
+		hosts[conn.Host] = *res
 	}
-	return
+	return hosts
+}
+
+// the errors from the results that have one
+func failures(results map[*Conn]*Result) map[*Conn]error {
+	errs := make(map[*Conn]error)
+	for conn, res := range results {
+		if res.Err != nil {
+			errs[conn] = res.Err
+		}
+	}
+	return errs
+}
+
+// run a task on a connection once it's ready, with start/finish events around
+// it, unless the pool or ctx says to stop
+func (pool *Pool) run(ctx context.Context, task Task, conn *Conn) *Result {
+	res := &Result{Host: conn.Host}
+	deadline, _ := ctx.Deadline()
+	if res.Err = pool.stopped(ctx); res.Err != nil {
+		return res
+	}
+	if res.Err = pool.ready(conn, deadline); res.Err != nil {
+		return res
+	}
+	// waiting for the connection may have taken a while
+	if res.Err = pool.stopped(ctx); res.Err != nil {
+		return res
+	}
+
+	pool.emit(EventTaskStart, conn, 0, 0, nil)
+	res.Start = time.Now()
+	if rt, ok := task.(ResultTask); ok {
+		res.Err = rt.RunResult(ctx, conn, res)
+	} else {
+		res.Err = task.Run(conn)
+	}
+	res.End = time.Now()
+	pool.emit(EventTaskFinish, conn, res.Duration(), 0, res.Err)
+	return res
+}
+
+// why no more tasks should be started, nil if they can be
+func (pool *Pool) stopped(ctx context.Context) error {
+	if pool.Cancelled() {
+		return ErrCancelled
+	}
+	return ctxError(ctx)
+}
+
+// ErrTimeout or ErrCancelled once ctx is done, nil before
+func ctxError(ctx context.Context) error {
+	switch ctx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return ErrTimeout
+	}
+	return ErrCancelled
+}
+
+// wait for a connection to be up before running a task on it. Connections
+// that dropped get ReconnectWait to come back, ones that never connected get
+// ConnectWait, and they're skipped as unreachable if they don't make it.
+// Ones that were removed, closed or given up on are skipped right away.
+func (pool *Pool) ready(conn *Conn, deadline time.Time) error {
+	if conn.Alive() {
+		return nil
+	} else if conn.stopped() {
+		return conn.unreachable()
+	}
+
+	wait := pool.ReconnectWait
+	never := conn.started().IsZero()
+	if never {
+		wait = pool.ConnectWait
+	}
+	if !deadline.IsZero() && deadline.Sub(time.Now()) < wait {
+		wait = deadline.Sub(time.Now())
+	}
+	if wait > 0 && conn.WaitAlive(wait) {
+		return nil
+	}
+	return conn.unreachable()
+}
+
+// the time by which a call to All etc. must finish, zero if there's no Timeout
+func (pool *Pool) deadline() time.Time {
+	if pool.Timeout > 0 {
+		return time.Now().Add(pool.Timeout)
+	}
+	return time.Time{}
+}
+
+// run the task on one connection at a time in the order they were added,
+// returns every host's result like All. The pool's Timeout is handled the
+// same way too, a task still running after it is given up on like in All and
+// the rest are skipped.
+func (pool *Pool) AllSerial(task Task) map[string]Result {
+	ctx := context.Background()
+	deadline := pool.deadline()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	results := make(map[string]Result)
+	for _, conn := range pool.Conns() {
+		// parallel with just one for the grace period of stuck tasks
+		for c, res := range pool.parallel(ctx, []*Conn{conn}, task, 2*KillGrace) {
+			results[c.Host] = *res
+		}
+	}
+	return results
 }
 
 // vim: ts=4 sw=4 noet tw=120 softtabstop=4
@@ -0,0 +1,180 @@
+// Copyright 2013 Albert P. Tobey. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gdssh
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// fail if there are more goroutines than before once things had a moment to settle
+func checkGoroutines(t *testing.T, before int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		buf := make([]byte, 1<<16)
+		t.Fatalf("%d goroutines left behind:\n%s", n-before, buf[:runtime.Stack(buf, true)])
+	}
+}
+
+func TestCloseLeavesNoGoroutines(t *testing.T) {
+	srv := newTestServer(t, false)
+	before := runtime.NumGoroutine()
+
+	pool := NewPool()
+	pool.Keepalive = 10 * time.Millisecond
+	for i := 0; i < 5; i++ {
+		pool.Add(srv.conn(""))
+	}
+	events := pool.Subscribe()
+	go func() {
+		for range events {
+		}
+	}()
+
+	pool.Start()
+	if healthy := len(pool.Healthy()); healthy != 5 {
+		t.Fatalf("expected 5 connections, got %d", healthy)
+	}
+	time.Sleep(50 * time.Millisecond) // a few rounds of keepalives
+	pool.Close()
+	pool.Close()
+
+	checkGoroutines(t, before)
+}
+
+func TestCloseInterruptsConnect(t *testing.T) {
+	// accepts connections and never says a word
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			nc, err := listener.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- nc
+		}
+	}()
+	defer func() {
+		listener.Close()
+		for nc := range accepted {
+			nc.Close()
+		}
+	}()
+	before := runtime.NumGoroutine()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	conn := NewConn(addr.IP.String(), addr.Port, "test", "")
+	conn.Agent = NewAgent("/nonexistent")
+	pool := NewPool()
+	pool.Add(conn) // no ConnectTimeout, only Close can get it out of the handshake
+
+	started := make(chan bool)
+	go func() {
+		pool.Start()
+		close(started)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	closed := make(chan bool)
+	go func() {
+		pool.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close waited for a connect in progress")
+	}
+	<-started
+
+	checkGoroutines(t, before)
+}
+
+func TestAddRemovedOrTwice(t *testing.T) {
+	srv := newTestServer(t, false)
+
+	pool := NewPool()
+	defer pool.Close()
+	conn := srv.conn("")
+	if err := pool.Add(conn); err != nil {
+		t.Fatalf("first Add failed: %s", err)
+	}
+	pool.Start()
+	if err := pool.Add(conn); err != ErrInPool {
+		t.Fatalf("expected ErrInPool adding it again, got %v", err)
+	}
+
+	if !pool.Remove(conn) {
+		t.Fatal("Remove didn't find the connection")
+	}
+	if err := pool.Add(conn); err != ErrStopped {
+		t.Fatalf("expected ErrStopped adding a removed connection, got %v", err)
+	}
+
+	// a new Conn for the same host is fine
+	again := srv.conn("")
+	if err := pool.Add(again); err != nil {
+		t.Fatalf("Add of a new connection failed: %s", err)
+	}
+	if !again.WaitAlive(5 * time.Second) {
+		t.Fatalf("new connection didn't come up: %v", again.LastError())
+	}
+	if conns := pool.Conns(); len(conns) != 1 || conns[0] != again {
+		t.Fatalf("expected only the new connection in the pool, got %d", len(conns))
+	}
+}
+
+// a plain Task that doesn't know about deadlines and hangs until released
+type stuckTask struct {
+	release chan bool
+}
+
+func (task *stuckTask) Run(conn *Conn) error {
+	<-task.release
+	return nil
+}
+
+func TestAllSerialTimeout(t *testing.T) {
+	srv := newTestServer(t, false)
+	defer func(grace time.Duration) { KillGrace = grace }(KillGrace)
+	KillGrace = 50 * time.Millisecond
+
+	pool := NewPool()
+	defer pool.Close()
+	pool.Add(srv.conn(""))
+	pool.Add(srv.conn(""))
+	pool.Start()
+	pool.Timeout = 100 * time.Millisecond
+
+	task := &stuckTask{release: make(chan bool)}
+	defer close(task.release)
+
+	returned := make(chan map[string]Result)
+	go func() {
+		returned <- pool.AllSerial(task)
+	}()
+	select {
+	case results := <-returned:
+		for host, res := range results {
+			if res.Err != ErrTimeout {
+				t.Errorf("%s: expected ErrTimeout, got %v", host, res.Err)
+			}
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("AllSerial waited for a stuck task past its Timeout")
+	}
+}
+
+// vim: ts=4 sw=4 noet tw=120 softtabstop=4
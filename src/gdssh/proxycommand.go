@@ -0,0 +1,101 @@
+// Copyright 2013 Albert P. Tobey. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gdssh
+
+// ProxyCommand support: a local command's stdin/stdout is used as the
+// connection instead of a tcp socket, e.g. nc -X 5 -x socks:1080 %h %p
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a running ProxyCommand that looks enough like a net.Conn for ssh
+type proxyConn struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	stdout  io.ReadCloser
+	command string
+	once    sync.Once
+}
+
+type proxyAddr string
+
+func (a proxyAddr) Network() string { return "proxy" }
+func (a proxyAddr) String() string  { return string(a) }
+
+// expand the %-tokens ssh supports in ProxyCommand
+func (conn *Conn) proxyCommand() string {
+	replacer := strings.NewReplacer(
+		"%%", "%",
+		"%h", conn.HostName,
+		"%n", conn.Host,
+		"%p", strconv.Itoa(conn.Port),
+		"%r", conn.User,
+	)
+	return replacer.Replace(conn.ProxyCommand)
+}
+
+// start the connection's ProxyCommand through the shell like ssh does, its
+// stderr goes to ours so errors from e.g. nc show up
+func dialProxy(command string) (net.Conn, error) {
+	cmd := exec.Command("/bin/sh", "-c", "exec "+command)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cmd.Start(); err != nil {
+		return nil, fmt.Errorf("ProxyCommand '%s' failed to start: %s", command, err)
+	}
+
+	return &proxyConn{cmd: cmd, stdin: stdin, stdout: stdout, command: command}, nil
+}
+
+func (pc *proxyConn) Read(b []byte) (int, error) {
+	return pc.stdout.Read(b)
+}
+
+func (pc *proxyConn) Write(b []byte) (int, error) {
+	return pc.stdin.Write(b)
+}
+
+// close the pipes and make sure the command goes away, it might not exit on
+// its own when stdin is closed
+func (pc *proxyConn) Close() error {
+	pc.once.Do(func() {
+		pc.stdin.Close()
+		pc.stdout.Close()
+		pc.cmd.Process.Kill()
+		pc.cmd.Wait()
+	})
+	return nil
+}
+
+func (pc *proxyConn) LocalAddr() net.Addr  { return proxyAddr("local") }
+func (pc *proxyConn) RemoteAddr() net.Addr { return proxyAddr(pc.command) }
+
+// pipes don't do deadlines, connect() closes the connection instead
+var errNoDeadline = errors.New("ProxyCommand connections do not support deadlines")
+
+func (pc *proxyConn) SetDeadline(t time.Time) error      { return errNoDeadline }
+func (pc *proxyConn) SetReadDeadline(t time.Time) error  { return errNoDeadline }
+func (pc *proxyConn) SetWriteDeadline(t time.Time) error { return errNoDeadline }
+
+// vim: ts=4 sw=4 noet tw=120 softtabstop=4
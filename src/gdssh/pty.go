@@ -0,0 +1,95 @@
+// Copyright 2013 Albert P. Tobey. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gdssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+)
+
+// Pty is a pseudo-terminal for a command, see SshCmd.Pty. With one, commands
+// act like they do under ssh -t: sudo can prompt, top and curses tools work,
+// and stderr ends up in Stdout.
+type Pty struct {
+	Term string // $TERM on the remote side, xterm if empty
+	Rows int
+	Cols int
+}
+
+// no echo, input is sent by the program and shouldn't show up in the output
+var ptyModes = ssh.TerminalModes{
+	ssh.ECHO:          0,
+	ssh.TTY_OP_ISPEED: 38400,
+	ssh.TTY_OP_OSPEED: 38400,
+}
+
+func (pty *Pty) request(sess *ssh.Session) error {
+	term := pty.Term
+	if term == "" {
+		term = "xterm"
+	}
+	return sess.RequestPty(term, pty.Rows, pty.Cols, ptyModes)
+}
+
+// a prompt nothing but sudo will print, so output that merely looks like a
+// sudo prompt (logs, echo, a hostile host) doesn't get the password. Start
+// puts it in $SUDO_PROMPT, without any % escapes so it's printed as is.
+func newSudoPrompt() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("[sudo] gdsh-%s password: ", hex.EncodeToString(token)), nil
+}
+
+// the command with $SUDO_PROMPT set, for any POSIX shell on the remote side
+func sudoCommand(prompt string, command string) string {
+	return fmt.Sprintf("SUDO_PROMPT='%s'; export SUDO_PROMPT; %s", prompt, command)
+}
+
+// keeps the last line of output, as much as a prompt needs
+const maxPromptLine = 256
+
+// follow the current line of output and answer sudo's password prompt when
+// it shows up, returns the updated line. sudo doesn't print the newline
+// until it has read the password, so the prompt ends the line.
+func (cmd *SshCmd) watchSudo(line []byte, data []byte) []byte {
+	if i := bytes.LastIndexAny(data, "\r\n"); i >= 0 {
+		line = append(line[:0], data[i+1:]...)
+	} else {
+		line = append(line, data...)
+	}
+	if len(line) > maxPromptLine {
+		line = append(line[:0], line[len(line)-maxPromptLine:]...)
+	}
+
+	if !bytes.HasSuffix(line, []byte(cmd.sudoPrompt)) {
+		return line
+	}
+	cmd.answerSudo()
+	return line[:0]
+}
+
+// the password goes out once. sudo only asks again when it was wrong, and
+// then gets EOF (^D on the terminal) so it gives up right away instead of
+// waiting for the timeout.
+func (cmd *SshCmd) answerSudo() {
+	cmd.stdinLock.Lock()
+	defer cmd.stdinLock.Unlock()
+
+	answer := []byte{4}
+	if !cmd.sudoAnswered {
+		cmd.sudoAnswered = true
+		if password, err := cmd.SudoPassword.Get(); err == nil {
+			answer = []byte(password + "\n")
+		}
+	}
+	cmd.stdin.Write(answer)
+}
+
+// vim: ts=4 sw=4 noet tw=120 softtabstop=4
@@ -0,0 +1,142 @@
+// Copyright 2013 Albert P. Tobey. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gdssh
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// the Kind of the HostError for hosts that failed the health check of a rollout
+var ErrCheckFailed = errors.New("health check failed")
+
+// settings for Pool.Rolling
+type Rollout struct {
+	BatchSize    int           // number of connections per batch
+	Check        Task          // optional health check run on each batch after the task
+	CheckTimeout time.Duration // how long to keep retrying a failing health check
+	MaxFailures  int           // stop after this many hosts fail, 0 to never stop
+}
+
+// Rolling runs the task on BatchSize connections at a time, in the order they
+// were added to the pool. If Check is set, it is run on every host in the batch
+// where the task succeeded, retrying every RetryInterval seconds until it passes
+// or CheckTimeout runs out. Hosts failing either the task or the check count
+// towards MaxFailures and once that's reached no more batches are started.
+// Batches still honor Fanout. Returns the task's result for each host it was
+// run on, except hosts that failed the check get ErrCheckFailed with Partial
+// set since the task itself worked. The error is set if any host failed the
+// check or the rollout was stopped.
+func (pool *Pool) Rolling(task Task, r Rollout) (map[string]Result, error) {
+	size := r.BatchSize
+	if size < 1 {
+		size = 1
+	}
+
+	conns := pool.Conns()
+	results := make(map[string]Result)
+	failed := 0
+	checkFailed := 0
+	batches := (len(conns) + size - 1) / size
+	for i := 0; i < len(conns); i += size {
+		if pool.Cancelled() {
+			return results, fmt.Errorf("rollout cancelled, %d hosts were not attempted", len(conns)-i)
+		}
+
+		end := i + size
+		if end > len(conns) {
+			end = len(conns)
+		}
+		batch := conns[i:end]
+
+		pool.events.emit(Event{
+			Type:    EventBatch,
+			Time:    time.Now(),
+			Batch:   i/size + 1,
+			Batches: batches,
+			Hosts:   hostList(batch),
+		})
+		batchResults := pool.all(batch, task)
+		for conn, res := range batchResults {
+			results[conn.Host] = *res
+		}
+		errs := failures(batchResults)
+		failed += len(errs)
+
+		if r.Check != nil {
+			// only check hosts where the task worked, the rest already failed
+			var pending []*Conn
+			for _, conn := range batch {
+				if _, failed := errs[conn]; !failed {
+					pending = append(pending, conn)
+				}
+			}
+			for conn, err := range pool.check(pending, r.Check, r.CheckTimeout) {
+				res := results[conn.Host]
+				res.Err = conn.hostError(ErrCheckFailed, err)
+				res.Partial = true
+				results[conn.Host] = res
+				failed++
+				checkFailed++
+			}
+		}
+
+		if r.MaxFailures > 0 && failed >= r.MaxFailures && end < len(conns) {
+			return results, fmt.Errorf("rollout stopped after %d failed hosts, %d hosts were not attempted",
+				failed, len(conns)-end)
+		}
+	}
+
+	if checkFailed > 0 {
+		return results, fmt.Errorf("%d hosts failed the health check", checkFailed)
+	}
+	return results, nil
+}
+
+// run the check on conns until it passes everywhere or the timeout is up, returns
+// the last error of each connection that never passed
+func (pool *Pool) check(conns []*Conn, check Task, timeout time.Duration) map[*Conn]error {
+	ivl := time.Duration(pool.RetryInterval) * time.Second
+	deadline := time.Now().Add(timeout)
+
+	var errs map[*Conn]error
+	for attempt := 1; len(conns) > 0; attempt++ {
+		errs = failures(pool.all(conns, check))
+
+		var failed []*Conn
+		for _, conn := range conns {
+			if _, ok := errs[conn]; ok {
+				failed = append(failed, conn)
+			}
+		}
+		conns = failed
+
+		if len(conns) == 0 || time.Now().Add(ivl).After(deadline) {
+			break
+		}
+
+		for _, conn := range conns {
+			pool.emit(EventCheckRetry, conn, ivl, attempt, errs[conn])
+		}
+		time.Sleep(ivl)
+	}
+
+	for _, conn := range conns {
+		pool.emit(EventCheckFailed, conn, timeout, 0, errs[conn])
+	}
+
+	return errs
+}
+
+func hostList(conns []*Conn) []string {
+	hosts := make([]string, len(conns))
+	for i, conn := range conns {
+		hosts[i] = conn.Host
+	}
+	return hosts
+}
+
+// vim: ts=4 sw=4 noet tw=120 softtabstop=4
@@ -0,0 +1,429 @@
+// Copyright 2013 Albert P. Tobey. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gdssh
+
+// ssh_config(5) support, only the parts gdssh uses. Host, Match (all, host,
+// originalhost, user and localuser) and Include are handled the same way
+// ssh does: the first value found for a keyword wins.
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// how deep Includes may nest, same limit as ssh
+const maxIncludeDepth = 16
+
+// how many jump hosts deep a connection may go, mostly to catch ProxyJump loops
+const maxJumpDepth = 8
+
+type SshConfig struct {
+	LocalUser string // for %u, Match localuser and the default remote user
+	lines     []*configLine
+	jumps     map[string]*Conn // jump hosts by ProxyJump spec, shared by all of their users
+	lock      sync.Mutex
+}
+
+// one keyword line, Include lines carry the lines of the included files
+type configLine struct {
+	keyword  string // lowercased
+	args     []string
+	value    string // the unsplit arguments, for ProxyCommand
+	included []*configLine
+	file     string
+	line     int
+}
+
+// settings for one host after going through the whole config
+type HostConfig struct {
+	HostName      string
+	User          string
+	Port          int
+	IdentityFiles []string
+	ProxyJump     string
+	ProxyCommand  string
+}
+
+// LoadSshConfig reads ssh_config files in order of precedence, usually
+// ~/.ssh/config then /etc/ssh/ssh_config. Files that don't exist are skipped.
+func LoadSshConfig(localUser string, files ...string) (*SshConfig, error) {
+	cfg := &SshConfig{LocalUser: localUser, jumps: make(map[string]*Conn)}
+	for _, file := range files {
+		lines, err := parseSshConfig(file, path.Dir(file), 0)
+		if err != nil {
+			return nil, err
+		}
+		cfg.lines = append(cfg.lines, lines...)
+	}
+	return cfg, nil
+}
+
+func parseSshConfig(file string, dir string, depth int) ([]*configLine, error) {
+	fd, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	var lines []*configLine
+	scanner := bufio.NewScanner(fd)
+	line_no := 0
+	for scanner.Scan() {
+		line_no++
+		keyword, args, value := splitConfigLine(scanner.Text())
+		if keyword == "" {
+			continue
+		}
+
+		cl := &configLine{keyword: keyword, args: args, value: value, file: file, line: line_no}
+		if keyword == "include" {
+			if depth >= maxIncludeDepth {
+				return nil, fmt.Errorf("%s:%d: too many nested Includes", file, line_no)
+			}
+			for _, pattern := range args {
+				pattern = expandTilde(pattern)
+				if !path.IsAbs(pattern) {
+					pattern = path.Join(dir, pattern)
+				}
+				// no matches is fine, like ssh
+				matches, _ := filepath.Glob(pattern)
+				for _, match := range matches {
+					included, err := parseSshConfig(match, dir, depth+1)
+					if err != nil {
+						return nil, err
+					}
+					cl.included = append(cl.included, included...)
+				}
+			}
+		}
+
+		lines = append(lines, cl)
+	}
+
+	return lines, scanner.Err()
+}
+
+// split "Keyword args", "Keyword=args" and quoted arguments, returns an empty
+// keyword for blank lines and comments
+func splitConfigLine(text string) (string, []string, string) {
+	text = strings.TrimSpace(text)
+	if text == "" || strings.HasPrefix(text, "#") {
+		return "", nil, ""
+	}
+
+	end := strings.IndexAny(text, " \t=")
+	if end < 0 {
+		return strings.ToLower(text), nil, ""
+	}
+	keyword := strings.ToLower(text[:end])
+	rest := strings.TrimLeft(text[end:], " \t")
+	rest = strings.TrimLeft(strings.TrimPrefix(rest, "="), " \t")
+	value := rest
+
+	var args []string
+	for len(rest) > 0 {
+		var arg string
+		if rest[0] == '"' {
+			close := strings.Index(rest[1:], "\"")
+			if close < 0 {
+				arg, rest = rest[1:], ""
+			} else {
+				arg, rest = rest[1:close+1], rest[close+2:]
+			}
+		} else if i := strings.IndexAny(rest, " \t"); i >= 0 {
+			arg, rest = rest[:i], rest[i:]
+		} else {
+			arg, rest = rest, ""
+		}
+		args = append(args, arg)
+		rest = strings.TrimLeft(rest, " \t")
+	}
+
+	return keyword, args, value
+}
+
+// Lookup returns the settings for a host as ssh would see them. user is the
+// remote user if one was given explicitly, otherwise empty.
+func (cfg *SshConfig) Lookup(host string, user string) HostConfig {
+	hc := HostConfig{User: user}
+	cfg.walk(cfg.lines, true, host, &hc)
+
+	if hc.HostName == "" {
+		hc.HostName = host
+	}
+	if hc.User == "" {
+		hc.User = cfg.LocalUser
+	}
+	for i, file := range hc.IdentityFiles {
+		hc.IdentityFiles[i] = cfg.expand(file, host, &hc)
+	}
+
+	return hc
+}
+
+func (cfg *SshConfig) walk(lines []*configLine, active bool, host string, hc *HostConfig) {
+	for _, cl := range lines {
+		switch cl.keyword {
+		case "host":
+			active = matchPatterns(cl.args, host)
+		case "match":
+			active = cfg.match(cl.args, host, hc)
+		case "include":
+			// an Include in a Host/Match block that doesn't apply brings in
+			// nothing, not even the Host blocks of the included files that
+			// would. Host/Match in included files only last until the end
+			// of the file.
+			if active {
+				cfg.walk(cl.included, true, host, hc)
+			}
+		default:
+			if active && len(cl.args) > 0 {
+				cfg.set(cl, host, hc)
+			}
+		}
+	}
+}
+
+func (cfg *SshConfig) set(cl *configLine, host string, hc *HostConfig) {
+	switch cl.keyword {
+	case "hostname":
+		if hc.HostName == "" {
+			hc.HostName = cfg.expand(cl.args[0], host, hc)
+		}
+	case "user":
+		if hc.User == "" {
+			hc.User = cl.args[0]
+		}
+	case "port":
+		if hc.Port == 0 {
+			hc.Port, _ = strconv.Atoi(cl.args[0])
+		}
+	case "identityfile":
+		// the only one that accumulates
+		hc.IdentityFiles = append(hc.IdentityFiles, cl.args[0])
+	case "proxyjump":
+		// whichever of ProxyJump and ProxyCommand comes first wins, same as ssh
+		if hc.ProxyJump == "" && hc.ProxyCommand == "" {
+			hc.ProxyJump = cl.args[0]
+		}
+	case "proxycommand":
+		if hc.ProxyJump == "" && hc.ProxyCommand == "" {
+			hc.ProxyCommand = cl.value
+		}
+	}
+}
+
+// true if host matches any of the comma or space separated patterns and none of the negated ones
+func matchPatterns(patterns []string, host string) bool {
+	matched := false
+	for _, arg := range patterns {
+		for _, pattern := range strings.Split(arg, ",") {
+			if strings.HasPrefix(pattern, "!") {
+				if wildcardMatch(pattern[1:], host) {
+					return false
+				}
+			} else if wildcardMatch(pattern, host) {
+				matched = true
+			}
+		}
+	}
+	return matched
+}
+
+// Match criteria, all of them have to be true. exec, canonical, final and
+// anything else unsupported never match.
+func (cfg *SshConfig) match(args []string, host string, hc *HostConfig) bool {
+	for i := 0; i < len(args); i++ {
+		criterion := strings.ToLower(args[i])
+		negate := strings.HasPrefix(criterion, "!")
+		criterion = strings.TrimPrefix(criterion, "!")
+
+		if criterion == "all" {
+			if negate {
+				return false
+			}
+			continue
+		}
+
+		if i+1 >= len(args) {
+			return false
+		}
+		i++
+		patterns := []string{args[i]}
+
+		var result bool
+		switch criterion {
+		case "host":
+			hostname := hc.HostName
+			if hostname == "" {
+				hostname = host
+			}
+			result = matchPatterns(patterns, hostname)
+		case "originalhost":
+			result = matchPatterns(patterns, host)
+		case "user":
+			user := hc.User
+			if user == "" {
+				user = cfg.LocalUser
+			}
+			result = matchPatterns(patterns, user)
+		case "localuser":
+			result = matchPatterns(patterns, cfg.LocalUser)
+		default:
+			return false
+		}
+
+		if result == negate {
+			return false
+		}
+	}
+	return true
+}
+
+// expand ~ and the %-tokens ssh supports in HostName and IdentityFile that make sense here
+func (cfg *SshConfig) expand(value string, host string, hc *HostConfig) string {
+	value = expandTilde(value)
+
+	hostname := hc.HostName
+	if hostname == "" {
+		hostname = host
+	}
+	replacer := strings.NewReplacer(
+		"%%", "%",
+		"%d", os.Getenv("HOME"),
+		"%h", hostname,
+		"%n", host,
+		"%r", hc.User,
+		"%u", cfg.LocalUser,
+	)
+	return replacer.Replace(value)
+}
+
+func expandTilde(file string) string {
+	if file == "~" || strings.HasPrefix(file, "~/") {
+		return path.Join(os.Getenv("HOME"), file[1:])
+	}
+	return file
+}
+
+// Conn creates a connection with its settings resolved through the config.
+// Like ssh, explicit settings win: port 0 and empty user or key mean "not
+// given" and are taken from the config, falling back to port 22 and LocalUser.
+// A ProxyJump from the config is set up as the connection's Jump and a
+// ProxyCommand is passed on as is.
+func (cfg *SshConfig) Conn(host string, port int, user string, key string) (*Conn, error) {
+	return cfg.conn(host, port, user, key, 0)
+}
+
+func (cfg *SshConfig) conn(host string, port int, user string, key string, depth int) (*Conn, error) {
+	hc := cfg.Lookup(host, user)
+	conn := cfg.newConn(host, hc, port, key)
+
+	var err error
+	conn.Jump, err = cfg.jumpHost(hc.ProxyJump, depth+1)
+	if err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (cfg *SshConfig) newConn(host string, hc HostConfig, port int, key string) *Conn {
+	if port == 0 {
+		port = hc.Port
+	}
+	conn := NewConn(host, port, hc.User, key)
+	conn.HostName = hc.HostName
+	conn.address = fmt.Sprintf("%s:%d", hc.HostName, conn.Port)
+	conn.IdentityFiles = hc.IdentityFiles
+	if hc.ProxyCommand != "none" {
+		conn.ProxyCommand = hc.ProxyCommand
+	}
+	return conn
+}
+
+// JumpHost returns the connection for a ProxyJump/ssh -J style list of jump
+// hosts, [user@]host[:port][,[user@]host[:port]...], or nil for "" and "none".
+// Each hop is resolved through the config and connects through the one before
+// it. Connections are shared by everything using the same hops, so a whole
+// cluster goes through one multiplexed connection to its bastion.
+func (cfg *SshConfig) JumpHost(spec string) (*Conn, error) {
+	return cfg.jumpHost(spec, 0)
+}
+
+func (cfg *SshConfig) jumpHost(spec string, depth int) (*Conn, error) {
+	if spec == "" || spec == "none" {
+		return nil, nil
+	}
+	if depth > maxJumpDepth {
+		return nil, fmt.Errorf("too many jump hosts at '%s', is there a ProxyJump loop in ssh_config?", spec)
+	}
+
+	var jump *Conn
+	hops := strings.Split(spec, ",")
+	for i, hop := range hops {
+		key := strings.Join(hops[:i+1], ",")
+		cfg.lock.Lock()
+		cached, ok := cfg.jumps[key]
+		cfg.lock.Unlock()
+		if ok {
+			jump = cached
+			continue
+		}
+
+		user, host, port, err := splitJumpHost(hop)
+		if err != nil {
+			return nil, err
+		}
+
+		// like ssh, the first hop can have its own ProxyJump, the rest go through the previous hop
+		var next *Conn
+		if jump == nil {
+			next, err = cfg.conn(host, port, user, "", depth)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			next = cfg.newConn(host, cfg.Lookup(host, user), port, "")
+			next.Jump = jump
+		}
+
+		cfg.lock.Lock()
+		cfg.jumps[key] = next
+		cfg.lock.Unlock()
+		jump = next
+	}
+
+	return jump, nil
+}
+
+// [user@]host[:port], port 0 if not given
+func splitJumpHost(hop string) (user string, host string, port int, err error) {
+	host = hop
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		user, host = host[:i], host[i+1:]
+	}
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		port, err = strconv.Atoi(host[i+1:])
+		if err != nil {
+			return "", "", 0, fmt.Errorf("invalid port in jump host '%s'", hop)
+		}
+		host = host[:i]
+	}
+	if host == "" {
+		return "", "", 0, fmt.Errorf("invalid jump host '%s'", hop)
+	}
+	return
+}
+
+// vim: ts=4 sw=4 noet tw=120 softtabstop=4
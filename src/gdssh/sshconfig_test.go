@@ -0,0 +1,272 @@
+// Copyright 2013 Albert P. Tobey. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gdssh
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestSplitConfigLine(t *testing.T) {
+	tests := []struct {
+		text    string
+		keyword string
+		args    []string
+		value   string
+	}{
+		{"", "", nil, ""},
+		{"   # a comment", "", nil, ""},
+		{"HostName web1.example.com", "hostname", []string{"web1.example.com"}, "web1.example.com"},
+		{"\tPORT   2222  ", "port", []string{"2222"}, "2222"},
+		{"User=deploy", "user", []string{"deploy"}, "deploy"},
+		{"User = deploy", "user", []string{"deploy"}, "deploy"},
+		{"Host web1 web2,web3", "host", []string{"web1", "web2,web3"}, "web1 web2,web3"},
+		{`IdentityFile "~/.ssh/my key"`, "identityfile", []string{"~/.ssh/my key"}, `"~/.ssh/my key"`},
+		{`Host "unterminated`, "host", []string{"unterminated"}, `"unterminated`},
+		{"ProxyCommand nc -X 5 -x socks:1080 %h %p", "proxycommand",
+			[]string{"nc", "-X", "5", "-x", "socks:1080", "%h", "%p"}, "nc -X 5 -x socks:1080 %h %p"},
+		{"Compression", "compression", nil, ""},
+	}
+
+	for _, test := range tests {
+		keyword, args, value := splitConfigLine(test.text)
+		if keyword != test.keyword || strings.Join(args, "|") != strings.Join(test.args, "|") || value != test.value {
+			t.Errorf("%q: expected %q %q %q, got %q %q %q", test.text,
+				test.keyword, test.args, test.value, keyword, args, value)
+		}
+	}
+}
+
+func TestSshConfigLookup(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("HOME", "/home/me")
+
+	tests := []struct {
+		name   string
+		config string
+		files  map[string]string // more files next to the config, for Include
+		host   string
+		user   string // given explicitly
+		want   HostConfig
+	}{
+		{
+			name: "no config", host: "web1",
+			want: HostConfig{HostName: "web1", User: "me"},
+		},
+		{
+			name:   "host block",
+			config: "Host web1\n  HostName 10.0.0.1\n  User deploy\n  Port 2222\n",
+			host:   "web1",
+			want:   HostConfig{HostName: "10.0.0.1", User: "deploy", Port: 2222},
+		},
+		{
+			name:   "other host",
+			config: "Host web1\n  HostName 10.0.0.1\n",
+			host:   "web2",
+			want:   HostConfig{HostName: "web2", User: "me"},
+		},
+		{
+			name:   "first value wins",
+			config: "Host web*\n  User first\n  Port 2222\nHost *\n  User second\n  Port 22\n  HostName %h.example.com\n",
+			host:   "web1",
+			want:   HostConfig{HostName: "web1.example.com", User: "first", Port: 2222},
+		},
+		{
+			name:   "explicit user wins",
+			config: "Host *\n  User deploy\n",
+			host:   "web1", user: "root",
+			want: HostConfig{HostName: "web1", User: "root"},
+		},
+		{
+			name:   "settings before any Host apply to everything",
+			config: "User deploy\nHost web1\n  User other\n",
+			host:   "web1",
+			want:   HostConfig{HostName: "web1", User: "deploy"},
+		},
+		{
+			name:   "negated pattern",
+			config: "Host *.example.com !db.example.com\n  User deploy\n",
+			host:   "db.example.com",
+			want:   HostConfig{HostName: "db.example.com", User: "me"},
+		},
+		{
+			name:   "comma separated patterns",
+			config: "Host db1,db2\n  User postgres\n",
+			host:   "db2",
+			want:   HostConfig{HostName: "db2", User: "postgres"},
+		},
+		{
+			name:   "identity files accumulate and expand",
+			config: "Host web1\n  IdentityFile ~/.ssh/%n_%r\nHost *\n  IdentityFile %d/.ssh/%u-%h\n  IdentityFile 100%%\n",
+			host:   "web1", user: "root",
+			want: HostConfig{HostName: "web1", User: "root",
+				IdentityFiles: []string{"/home/me/.ssh/web1_root", "/home/me/.ssh/me-web1", "100%"}},
+		},
+		{
+			name:   "match host sees the HostName",
+			config: "Host web1\n  HostName 10.0.0.1\nMatch host 10.0.0.*\n  User ops\n",
+			host:   "web1",
+			want:   HostConfig{HostName: "10.0.0.1", User: "ops"},
+		},
+		{
+			name:   "match originalhost",
+			config: "Host web1\n  HostName 10.0.0.1\nMatch originalhost web1\n  Port 2200\n",
+			host:   "web1",
+			want:   HostConfig{HostName: "10.0.0.1", User: "me", Port: 2200},
+		},
+		{
+			name:   "match user and localuser",
+			config: "Match user root localuser me\n  Port 2201\nMatch user deploy\n  Port 2202\n",
+			host:   "web1", user: "root",
+			want: HostConfig{HostName: "web1", User: "root", Port: 2201},
+		},
+		{
+			name:   "match negated",
+			config: "Match !host web1\n  Port 2203\nMatch all\n  Port 2204\n",
+			host:   "web1",
+			want:   HostConfig{HostName: "web1", User: "me", Port: 2204},
+		},
+		{
+			name:   "match exec never matches",
+			config: "Match exec true\n  Port 2205\n",
+			host:   "web1",
+			want:   HostConfig{HostName: "web1", User: "me"},
+		},
+		{
+			name:   "proxyjump before proxycommand",
+			config: "Host web1\n  ProxyJump bastion\nHost *\n  ProxyCommand nc %h %p\n",
+			host:   "web1",
+			want:   HostConfig{HostName: "web1", User: "me", ProxyJump: "bastion"},
+		},
+		{
+			name:   "proxycommand before proxyjump",
+			config: "Host web1\n  ProxyCommand nc -X 5 -x socks:1080 %h %p\nHost *\n  ProxyJump bastion\n",
+			host:   "web1",
+			want:   HostConfig{HostName: "web1", User: "me", ProxyCommand: "nc -X 5 -x socks:1080 %h %p"},
+		},
+		{
+			name:   "include relative to the config's directory",
+			config: "Include conf.d/*.conf\nHost *\n  User late\n",
+			files: map[string]string{
+				"conf.d/a.conf": "Host web1\n  User included\n",
+				"conf.d/b.conf": "Host *\n  Port 2206\n",
+			},
+			host: "web1",
+			want: HostConfig{HostName: "web1", User: "included", Port: 2206},
+		},
+		{
+			name:   "host blocks end with the included file",
+			config: "Include extra\nUser after\n",
+			files:  map[string]string{"extra": "Host other\n  Port 2207\n"},
+			host:   "web1",
+			want:   HostConfig{HostName: "web1", User: "after"},
+		},
+		{
+			name:   "include inside a host block that applies",
+			config: "Host web1\n  Include extra\n",
+			files:  map[string]string{"extra": "User included\nHost *\n  Port 2208\n"},
+			host:   "web1",
+			want:   HostConfig{HostName: "web1", User: "included", Port: 2208},
+		},
+		{
+			name:   "include inside a host block that doesn't apply",
+			config: "Host db1\n  Include extra\n",
+			files:  map[string]string{"extra": "User included\nHost *\n  Port 2209\n"},
+			host:   "web1",
+			want:   HostConfig{HostName: "web1", User: "me"},
+		},
+		{
+			name:   "nested includes",
+			config: "Include one\n",
+			files:  map[string]string{"one": "Include two\nPort 2210\n", "two": "User two\n"},
+			host:   "web1",
+			want:   HostConfig{HostName: "web1", User: "two", Port: 2210},
+		},
+		{
+			name:   "missing include is fine",
+			config: "Include nothing-here/*\nUser deploy\n",
+			host:   "web1",
+			want:   HostConfig{HostName: "web1", User: "deploy"},
+		},
+	}
+
+	for i, test := range tests {
+		testDir := path.Join(dir, strings.Repeat("t", i+1))
+		for name, text := range test.files {
+			writeTestFile(t, path.Join(testDir, name), text)
+		}
+		config := path.Join(testDir, "config")
+		writeTestFile(t, config, test.config)
+
+		cfg, err := LoadSshConfig("me", config)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		got := cfg.Lookup(test.host, test.user)
+		if got.HostName != test.want.HostName || got.User != test.want.User || got.Port != test.want.Port ||
+			strings.Join(got.IdentityFiles, " ") != strings.Join(test.want.IdentityFiles, " ") ||
+			got.ProxyJump != test.want.ProxyJump || got.ProxyCommand != test.want.ProxyCommand {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestSshConfigIncludeLoop(t *testing.T) {
+	dir := t.TempDir()
+	config := path.Join(dir, "config")
+	writeTestFile(t, config, "Include config\n")
+	if _, err := LoadSshConfig("me", config); err == nil {
+		t.Fatal("expected an error for an Include loop")
+	}
+}
+
+func TestSshConfigConn(t *testing.T) {
+	dir := t.TempDir()
+	config := path.Join(dir, "config")
+	writeTestFile(t, config, "Host web*\n  HostName %h.internal\n  Port 2222\n  ProxyJump ops@bastion:2200\n"+
+		"Host bastion\n  HostName bastion.example.com\n")
+
+	cfg, err := LoadSshConfig("me", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	web1, err := cfg.Conn("web1", 0, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if web1.address != "web1.internal:2222" || web1.User != "me" {
+		t.Errorf("expected me@web1.internal:2222, got %s@%s", web1.User, web1.address)
+	}
+	if jump := web1.Jump; jump == nil || jump.address != "bastion.example.com:2200" || jump.User != "ops" {
+		t.Fatalf("expected the jump host ops@bastion.example.com:2200, got %+v", jump)
+	}
+
+	// an explicit port wins and the jump host is shared
+	web2, err := cfg.Conn("web2", 22, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if web2.address != "web2.internal:22" {
+		t.Errorf("expected web2.internal:22, got %s", web2.address)
+	}
+	if web2.Jump != web1.Jump {
+		t.Error("expected web1 and web2 to share their jump host")
+	}
+}
+
+func writeTestFile(t *testing.T, file string, text string) {
+	if err := os.MkdirAll(path.Dir(file), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte(text), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// vim: ts=4 sw=4 noet tw=120 softtabstop=4
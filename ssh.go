@@ -6,14 +6,210 @@ package main
 
 import (
 	"./src/gdssh"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"time"
 )
 
 func sshPool(opt GdshOptions) *gdssh.Pool {
-	list := hostPortMap(opt.List)
 	pool := gdssh.NewPool()
-	pool.Configure(list, opt.User, opt.Key)
+	pool.Fanout = opt.Fanout
+	pool.ConnectTimeout = time.Duration(opt.ConnTimeout) * time.Second
+	pool.CommandTimeout = time.Duration(opt.CmdTimeout) * time.Second
+	pool.Timeout = time.Duration(opt.TotalTimeout) * time.Second
+	pool.Keepalive = time.Duration(opt.Keepalive) * time.Second
+	pool.ConnectWait = time.Duration(opt.ConnectWait) * time.Second
+
+	// same files ssh(1) uses, new keys go in the user's file
+	userFile := path.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+	kh, err := gdssh.LoadKnownHosts(opt.HostKeys, userFile, "/etc/ssh/ssh_known_hosts")
+	if err != nil {
+		log.Fatal("Could not load known_hosts: ", err)
+	}
+	pool.KnownHosts = kh
+
+	// for unattended runs with an encrypted --key, otherwise it's asked for on the terminal
+	if passphrase := os.Getenv("GDSH_KEY_PASSPHRASE"); passphrase != "" {
+		gdssh.Passphrase = func(keyfile string) ([]byte, error) {
+			return []byte(passphrase), nil
+		}
+	}
+
+	if pool.Agent != nil {
+		pool.Agent.MaxSigning = opt.AgentLimit
+	}
+
+	// opt-in since most hosts should be using keys, asked for up front so the
+	// prompt isn't racing connect timeouts
+	if opt.Password {
+		pool.Password = sshPassword(opt)
+		if _, err := pool.Password.Get(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// resolve hosts the same way nssh/ssh(1) would, --user and list ports still win
+	localUser := UserIdToUsername(os.Geteuid())
+	userConfig := path.Join(os.Getenv("HOME"), ".ssh", "config")
+	cfg, err := gdssh.LoadSshConfig(localUser, userConfig, "/etc/ssh/ssh_config")
+	if err != nil {
+		log.Fatal("Could not load ssh_config: ", err)
+	}
+
+	// add in list order rather than using Configure's map so --batch goes down the list
+	for _, node := range loadListByName(opt.List) {
+		conn, err := cfg.Conn(node.Address, node.Port, opt.User, opt.Key)
+		if err != nil {
+			log.Fatal(node.Address, ": ", err)
+		}
+		if conn.User == "" {
+			log.Fatal("Could not determine username. Use --user, set User in ~/.ssh/config or fix your /etc/passwd.")
+		}
+
+		// --jump/--proxy-command beat @jump in the list beats ProxyJump/ProxyCommand in ssh_config
+		jump := node.Jump
+		if opt.Jump != "" {
+			jump = opt.Jump
+		}
+		if opt.ProxyCmd != "" {
+			conn.Jump = nil
+			conn.ProxyCommand = opt.ProxyCmd
+		} else if jump != "" {
+			if conn.Jump, err = cfg.JumpHost(jump); err != nil {
+				log.Fatal(node.Address, ": ", err)
+			}
+			conn.ProxyCommand = ""
+		}
+
+		pool.Add(conn)
+	}
+	go renderEvents(pool.Subscribe(), opt.Verbose)
 	pool.Start()
 	return pool
 }
 
+// closed by renderEvents once the pool is closed and every event is printed
+var eventsDone = make(chan bool)
+
+// close the pool and wait for the last of its events to be printed, so they
+// don't show up after the summary or get lost when gdsh exits
+func closePool(pool *gdssh.Pool) {
+	pool.Close()
+	<-eventsDone
+}
+
+// list the hosts that were skipped because they never connected
+func reportUnreachable(pool *gdssh.Pool) {
+	var hosts []string
+	for _, conn := range pool.Unreachable() {
+		hosts = append(hosts, conn.Host)
+	}
+	if len(hosts) > 0 {
+		fmt.Fprintf(os.Stderr, "Skipped %d unreachable hosts: %s\n", len(hosts), compactHosts(hosts))
+	}
+}
+
+// print each host's error from All's results to stderr and the unreachable hosts on one
+// line, returns the exit status in the same terms as gdsh run
+func reportErrors(pool *gdssh.Pool, results map[string]gdssh.Result) int {
+	status := exitOk
+	var failed []string
+	for host, res := range results {
+		if res.Err == nil {
+			continue
+		} else if _, ok := res.Err.(*gdssh.UnreachableError); ok {
+			status = exitUnreachable // reportUnreachable lists these
+			continue
+		}
+		failed = append(failed, fmt.Sprintf("%s: %s", host, hostless(res.Err)))
+		if status == exitOk {
+			status = exitFailed
+		}
+	}
+
+	sort.Strings(failed)
+	for _, line := range failed {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", line)
+	}
+	reportUnreachable(pool)
+	return status
+}
+
+// the error without the host in front, for when it's already printed
+func hostless(err error) string {
+	var he *gdssh.HostError
+	if errors.As(err, &he) {
+		return fmt.Sprintf("%s: %s", he.Kind, he.Err)
+	}
+	return err.Error()
+}
+
+// the host was reachable but scp or the session failed on one end
+func remoteFailure(err error) bool {
+	return errors.Is(err, gdssh.ErrRemote) || errors.Is(err, gdssh.ErrScpProtocol) || errors.Is(err, gdssh.ErrLocal)
+}
+
+// print connection problems and rollout progress to stderr as they happen,
+// everything else with --verbose
+func renderEvents(events <-chan gdssh.Event, verbose bool) {
+	defer close(eventsDone)
+	for ev := range events {
+		var msg string
+		switch ev.Type {
+		case gdssh.EventFailed:
+			msg = fmt.Sprintf("ERROR: %s", hostless(ev.Err))
+		case gdssh.EventReconnecting:
+			msg = fmt.Sprintf("retrying connection in %s (attempt %d)", ev.Elapsed, ev.Attempt)
+		case gdssh.EventConnected:
+			if ev.Attempt > 0 {
+				msg = fmt.Sprintf("reconnected after %d attempts", ev.Attempt)
+			} else if verbose {
+				msg = fmt.Sprintf("connected in %s", ev.Elapsed)
+			}
+		case gdssh.EventBatch:
+			fmt.Fprintf(os.Stderr, "[%s] Batch %d/%d: %s\n", ev.Time.Format("15:04:05"),
+				ev.Batch, ev.Batches, compactHosts(ev.Hosts))
+		case gdssh.EventCheckRetry:
+			msg = fmt.Sprintf("health check failed, retrying in %s: %s", ev.Elapsed, ev.Err)
+		case gdssh.EventCheckFailed:
+			msg = fmt.Sprintf("ERROR: health check did not pass within %s: %s", ev.Elapsed, ev.Err)
+		case gdssh.EventTaskFinish:
+			if verbose && ev.Err != nil {
+				msg = fmt.Sprintf("finished in %s: %s", ev.Elapsed, ev.Err)
+			} else if verbose {
+				msg = fmt.Sprintf("finished in %s", ev.Elapsed)
+			}
+		default:
+			if verbose {
+				msg = ev.Type.String()
+			}
+		}
+
+		if msg != "" {
+			fmt.Fprintf(os.Stderr, "[%s] %s: %s\n", ev.Time.Format("15:04:05"), ev.Host, msg)
+		}
+	}
+}
+
+// --password-file, then $GDSH_PASSWORD, then ask on the terminal
+func sshPassword(opt GdshOptions) *gdssh.Password {
+	if opt.PasswordFile != "" {
+		pw, err := gdssh.FilePassword(opt.PasswordFile)
+		if err != nil {
+			log.Fatal("Could not use --password-file: ", err)
+		}
+		return pw
+	}
+
+	if pw, err := gdssh.EnvPassword("GDSH_PASSWORD"); err == nil {
+		return pw
+	}
+
+	return gdssh.PromptPassword()
+}
+
 // vim: ts=4 sw=4 noet tw=120 softtabstop=4
@@ -0,0 +1,135 @@
+// Copyright 2013 Albert P. Tobey. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"./src/gdssh"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+)
+
+// stdinSpool reads local stdin once and lets every host's command read all of
+// it from the beginning, no matter how late it starts (--fanout, --batch). It's
+// kept in an unlinked temp file so tarballs and the like don't have to fit in
+// memory, and hosts read at their own pace instead of the slowest one's.
+type stdinSpool struct {
+	file *os.File
+	size int64 // bytes in file so far
+	eof  bool  // stdin is done, read errors are treated as EOF too
+	lock sync.Mutex
+	cond *sync.Cond // signaled when size or eof changes and by stop funcs
+}
+
+// chunk size for reading stdin and sending it on
+const spoolChunk = 32 * 1024
+
+func spoolStdin() *stdinSpool {
+	f, err := ioutil.TempFile("", "gdsh-stdin-")
+	if err != nil {
+		log.Fatal("Could not create a temp file to hold stdin: ", err)
+	}
+	os.Remove(f.Name()) // gone when gdsh exits
+
+	sp := &stdinSpool{file: f}
+	sp.cond = sync.NewCond(&sp.lock)
+	go sp.fill(os.Stdin)
+	return sp
+}
+
+func (sp *stdinSpool) fill(r io.Reader) {
+	buf := make([]byte, spoolChunk)
+	for {
+		read, err := r.Read(buf)
+		if read > 0 {
+			// only this goroutine changes size, so reading it unlocked is fine
+			if _, werr := sp.file.WriteAt(buf[0:read], sp.size); werr != nil {
+				log.Printf("Could not spool stdin, hosts get only the first %d bytes: %s", sp.size, werr)
+				err = werr
+			} else {
+				sp.lock.Lock()
+				sp.size += int64(read)
+				sp.cond.Broadcast()
+				sp.lock.Unlock()
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Reading stdin failed after %d bytes: %s", sp.size, err)
+			}
+			sp.lock.Lock()
+			sp.eof = true
+			sp.cond.Broadcast()
+			sp.lock.Unlock()
+			return
+		}
+	}
+}
+
+// start sending everything from stdin to the command's Stdin, closing it at
+// the end so the remote command sees EOF. Call stop once the command is over,
+// nothing reads Stdin after that.
+func (sp *stdinSpool) feed(cmd *gdssh.SshCmd) (stop func()) {
+	done := make(chan bool)
+	go sp.send(cmd, done)
+
+	return func() {
+		sp.lock.Lock()
+		close(done)
+		sp.cond.Broadcast()
+		sp.lock.Unlock()
+	}
+}
+
+func (sp *stdinSpool) send(cmd *gdssh.SshCmd, done chan bool) {
+	var offset int64
+	for {
+		sp.lock.Lock()
+		for offset >= sp.size && !sp.eof && !closed(done) {
+			sp.cond.Wait()
+		}
+		size, eof, stopped := sp.size, sp.eof, closed(done)
+		sp.lock.Unlock()
+
+		if stopped {
+			return
+		} else if offset >= size && eof {
+			close(cmd.Stdin)
+			return
+		}
+
+		// new buffer every time, the receiver may still be using the last one
+		chunk := size - offset
+		if chunk > spoolChunk {
+			chunk = spoolChunk
+		}
+		buf := make([]byte, chunk)
+		if _, err := sp.file.ReadAt(buf, offset); err != nil {
+			log.Printf("Could not read spooled stdin: %s", err)
+			close(cmd.Stdin)
+			return
+		}
+
+		select {
+		case cmd.Stdin <- buf:
+			offset += chunk
+		case <-done:
+			return
+		}
+	}
+}
+
+func closed(ch chan bool) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// vim: ts=4 sw=4 noet tw=120 softtabstop=4